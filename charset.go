@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	xunicode "golang.org/x/text/encoding/unicode"
+)
+
+const (
+	latinFrequent    = "àáâãäåæçèéêëíîïñòóôõöøùúûüýßœÀÁÂÄÅÇÉÈÊÍÓÖØÚÜÑ"
+	centralFrequent  = "áäéíóôúýąćęłńśźżčďěňřšťůžőűăâîşţÁÉÍÓÚÝĄĆĘŁŃŚŹŻČĎĚŇŘŠŤŮŽŐŰĂŞŢ"
+	cyrillicFrequent = "оеаинтсрвлкмдпуяыьгзбчй"
+	greekFrequent    = "αεοιτνσηρκπμλυάέίόήύώ"
+)
+
+// subtitleCharsets are the legacy single-byte encodings tried when subtitle
+// content is not UTF-8, in order of preference when scores tie.
+var subtitleCharsets = []struct {
+	name     string
+	enc      encoding.Encoding
+	frequent string // common non-ASCII letters in languages using the charset
+}{
+	{"windows-1252", charmap.Windows1252, latinFrequent},
+	{"windows-1250", charmap.Windows1250, centralFrequent},
+	{"iso-8859-2", charmap.ISO8859_2, centralFrequent},
+	{"windows-1251", charmap.Windows1251, cyrillicFrequent},
+	{"koi8-r", charmap.KOI8R, cyrillicFrequent},
+	{"iso-8859-5", charmap.ISO8859_5, cyrillicFrequent},
+	{"windows-1253", charmap.Windows1253, greekFrequent},
+	{"iso-8859-7", charmap.ISO8859_7, greekFrequent},
+}
+
+// decodeSubtitle detects the character encoding of subtitle content and
+// returns it transcoded to UTF-8 along with the name of the detected encoding.
+// A byte order mark wins, then a UTF-16 zero-byte heuristic, then UTF-8
+// validity, and finally the best scoring legacy charset.
+func decodeSubtitle(content []byte) ([]byte, string) {
+	switch {
+	case bytes.HasPrefix(content, []byte("\xEF\xBB\xBF")):
+		return content[3:], "UTF-8"
+	case bytes.HasPrefix(content, []byte("\xFF\xFE")):
+		return decodeWith(xunicode.UTF16(xunicode.LittleEndian, xunicode.IgnoreBOM), content[2:]), "UTF-16LE"
+	case bytes.HasPrefix(content, []byte("\xFE\xFF")):
+		return decodeWith(xunicode.UTF16(xunicode.BigEndian, xunicode.IgnoreBOM), content[2:]), "UTF-16BE"
+	}
+
+	if endian, ok := guessUTF16(content); ok {
+		name := "UTF-16LE"
+		if endian == xunicode.BigEndian {
+			name = "UTF-16BE"
+		}
+		return decodeWith(xunicode.UTF16(endian, xunicode.IgnoreBOM), content), name
+	}
+
+	if utf8.Valid(content) {
+		return content, "UTF-8"
+	}
+
+	best, bestScore := content, 0
+	bestName := ""
+	for _, cs := range subtitleCharsets {
+		decoded, err := cs.enc.NewDecoder().Bytes(content)
+		if err != nil {
+			continue
+		}
+		score := scoreDecoded(string(decoded), cs.frequent)
+		if bestName == "" || score > bestScore {
+			best, bestScore, bestName = decoded, score, cs.name
+		}
+	}
+	if bestName == "" {
+		return bytes.ToValidUTF8(content, []byte("\uFFFD")), "UTF-8"
+	}
+	return best, bestName
+}
+
+func decodeWith(enc encoding.Encoding, content []byte) []byte {
+	decoded, err := enc.NewDecoder().Bytes(content)
+	if err != nil {
+		return bytes.ToValidUTF8(content, []byte("\uFFFD"))
+	}
+	return decoded
+}
+
+// guessUTF16 recognises BOM-less UTF-16 by where zero bytes fall. Subtitle
+// text is mostly ASCII, so one half of every code unit is usually zero.
+func guessUTF16(content []byte) (xunicode.Endianness, bool) {
+	n := len(content) &^ 1
+	if n > 4096 {
+		n = 4096
+	}
+	if n < 4 {
+		return xunicode.LittleEndian, false
+	}
+
+	var evenZeros, oddZeros int
+	for i := 0; i < n; i += 2 {
+		if content[i] == 0 {
+			evenZeros++
+		}
+		if content[i+1] == 0 {
+			oddZeros++
+		}
+	}
+
+	units := n / 2
+	switch {
+	case oddZeros*10 > units*4 && evenZeros*10 < units:
+		return xunicode.LittleEndian, true
+	case evenZeros*10 > units*4 && oddZeros*10 < units:
+		return xunicode.BigEndian, true
+	}
+	return xunicode.LittleEndian, false
+}
+
+// scoreDecoded rates how plausible text is as natural language. Common
+// letters for the charset score up, while control characters, stray symbols,
+// mixed scripts and odd case changes inside a word score down.
+func scoreDecoded(text, frequent string) int {
+	score := 0
+	prev := ' '
+	for _, r := range text {
+		if r >= utf8.RuneSelf {
+			switch {
+			case r == utf8.RuneError || unicode.IsControl(r) || unicode.Is(unicode.Co, r):
+				score -= 5
+			case strings.ContainsRune(frequent, r):
+				score += 2
+			case unicode.IsLetter(r), unicode.IsPunct(r), unicode.IsSpace(r):
+			default:
+				score--
+			}
+		}
+
+		if unicode.IsLetter(prev) && unicode.IsLetter(r) {
+			if unicode.IsLower(prev) && unicode.IsUpper(r) && (prev >= utf8.RuneSelf || r >= utf8.RuneSelf) {
+				score -= 3
+			}
+			if isLatinLetter(prev) != isLatinLetter(r) {
+				score -= 2
+			}
+		}
+		if prev == 'ς' && unicode.IsLetter(r) {
+			score -= 2
+		}
+		prev = r
+	}
+	return score
+}
+
+func isLatinLetter(r rune) bool {
+	return r < utf8.RuneSelf || unicode.Is(unicode.Latin, r)
+}
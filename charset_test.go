@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	xunicode "golang.org/x/text/encoding/unicode"
+)
+
+func TestDecodeSubtitle(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		enc      encoding.Encoding
+		bom      string
+		wantName string
+	}{
+		{"UTF-8", "Déjà vu, señor.", nil, "", "UTF-8"},
+		{"UTF-8 BOM", "Déjà vu, señor.", nil, "\xEF\xBB\xBF", "UTF-8"},
+		{"UTF-16LE BOM", "Привет, мир!", xunicode.UTF16(xunicode.LittleEndian, xunicode.IgnoreBOM), "\xFF\xFE", "UTF-16LE"},
+		{"UTF-16BE BOM", "Καλημέρα", xunicode.UTF16(xunicode.BigEndian, xunicode.IgnoreBOM), "\xFE\xFF", "UTF-16BE"},
+		{"UTF-16LE without BOM", "1\n00:00:01,000 --> 00:00:02,000\nCafé crème\n", xunicode.UTF16(xunicode.LittleEndian, xunicode.IgnoreBOM), "", "UTF-16LE"},
+		{"UTF-16BE without BOM", "1\n00:00:01,000 --> 00:00:02,000\nHello\n", xunicode.UTF16(xunicode.BigEndian, xunicode.IgnoreBOM), "", "UTF-16BE"},
+		{"Windows-1252 French", "Où est la bibliothèque ? Ça a été très difficile, à vrai dire.", charmap.Windows1252, "", "windows-1252"},
+		{"Windows-1252 German", "Können Sie mir helfen? Das ist größer als früher.", charmap.Windows1252, "", "windows-1252"},
+		{"Windows-1252 Spanish", "¿Qué pasó? El niño está aquí, señor.", charmap.Windows1252, "", "windows-1252"},
+		{"Windows-1250 Polish", "Zażółć gęślą jaźń. Proszę, chodź tutaj!", charmap.Windows1250, "", "windows-1250"},
+		{"Windows-1250 Czech", "Příliš žluťoučký kůň úpěl ďábelské ódy.", charmap.Windows1250, "", "windows-1250"},
+		{"ISO-8859-2 Polish", "Zażółć gęślą jaźń. Proszę, chodź tutaj!", charmap.ISO8859_2, "", "iso-8859-2"},
+		{"Windows-1251 Russian", "Привет! Как дела? Я не знаю, что сказать.", charmap.Windows1251, "", "windows-1251"},
+		{"KOI8-R Russian", "Привет! Как дела? Я не знаю, что сказать.", charmap.KOI8R, "", "koi8-r"},
+		{"ISO-8859-5 Russian", "Привет! Как дела? Я не знаю, что сказать.", charmap.ISO8859_5, "", "iso-8859-5"},
+		{"Windows-1253 Greek", "Καλημέρα σας, τι κάνετε; Είμαι πολύ καλά.", charmap.Windows1253, "", "windows-1253"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := []byte(tt.text)
+			if tt.enc != nil {
+				var err error
+				if raw, err = tt.enc.NewEncoder().Bytes(raw); err != nil {
+					t.Fatalf("encode: %v", err)
+				}
+			}
+			raw = append([]byte(tt.bom), raw...)
+
+			got, name := decodeSubtitle(raw)
+			if name != tt.wantName {
+				t.Errorf("decodeSubtitle() encoding = %q, want %q", name, tt.wantName)
+			}
+			if string(got) != tt.text {
+				t.Errorf("decodeSubtitle() = %q, want %q", got, tt.text)
+			}
+		})
+	}
+}
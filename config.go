@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is the server configuration, loaded from an optional JSON file and
+// then overridden by environment variables and command-line flags.
+type Config struct {
+	Port                  int                  `json:"port"`
+	OpenSubtitlesAPIKey   string               `json:"openSubtitlesApiKey"`
+	OpenSubtitlesUsername string               `json:"openSubtitlesUsername"` // optional, for the account download quota
+	OpenSubtitlesPassword string               `json:"openSubtitlesPassword"`
+	OpenSubtitlesBaseURL  string               `json:"openSubtitlesBaseUrl"`
+	SubtitlesDir          string               `json:"subtitlesDir"` // local subtitle provider, off if empty
+	SubtitleCache         SubtitleCacheConfig  `json:"subtitleCache"`
+	Manager               TorrentManagerConfig `json:"manager"`
+}
+
+// SubtitleCacheConfig sizes the cache in front of remote subtitle providers.
+type SubtitleCacheConfig struct {
+	SearchTTL Duration `json:"searchTtl"` // 0 disables caching searches
+	MaxSize   ByteSize `json:"maxSize"`   // of downloaded files; 0 disables caching them
+}
+
+// TorrentManagerConfig holds the tunables for a TorrentManager.
+type TorrentManagerConfig struct {
+	DataDir         string          `json:"dataDir"`
+	MaxDisk         ByteSize        `json:"maxDisk"` // 0 means unlimited
+	MetadataTimeout Duration        `json:"metadataTimeout"`
+	Readahead       []ReadaheadTier `json:"readahead"`
+	BufferTarget    Duration        `json:"bufferTarget"` // of playback to read ahead once the bitrate is known; 0 uses the tiers only
+	CleanupInterval Duration        `json:"cleanupInterval"`
+	CleanupMaxAge   Duration        `json:"cleanupMaxAge"`
+	QuotaInterval   Duration        `json:"quotaInterval"`
+	Seed            bool            `json:"seed"`
+	ListenPort      int             `json:"listenPort"` // 0 picks a random port
+}
+
+// ReadaheadTier applies Readahead to files of at least MinFileSize bytes.
+type ReadaheadTier struct {
+	MinFileSize ByteSize `json:"minFileSize"`
+	Readahead   ByteSize `json:"readahead"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Port:                 8080,
+		OpenSubtitlesBaseURL: openSubBaseURL,
+		SubtitleCache: SubtitleCacheConfig{
+			SearchTTL: Duration(time.Hour),
+			MaxSize:   50 << 20,
+		},
+		Manager: DefaultTorrentManagerConfig(),
+	}
+}
+
+func DefaultTorrentManagerConfig() TorrentManagerConfig {
+	return TorrentManagerConfig{
+		DataDir:         "/tmp/go-stream",
+		MetadataTimeout: Duration(60 * time.Second),
+		Readahead: []ReadaheadTier{
+			{MinFileSize: 0, Readahead: 16 << 20},
+			{MinFileSize: 500 << 20, Readahead: 32 << 20},
+			{MinFileSize: 2 << 30, Readahead: 64 << 20},
+		},
+		BufferTarget:    Duration(60 * time.Second),
+		CleanupInterval: Duration(10 * time.Minute),
+		CleanupMaxAge:   Duration(24 * time.Hour),
+		QuotaInterval:   Duration(time.Minute),
+	}
+}
+
+// LoadConfigFile overlays the JSON file at path onto cfg. Unknown keys are
+// rejected so typos don't silently fall back to defaults.
+func LoadConfigFile(path string, cfg *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config: %w", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return fmt.Errorf("parse config %s: %w", path, err)
+	}
+	return nil
+}
+
+// ApplyEnv overrides cfg from GO_STREAM_* and OPENSUBTITLES_* environment
+// variables.
+func ApplyEnv(cfg *Config) error {
+	var errs []error
+	env := func(name string, apply func(string) error) {
+		v, ok := os.LookupEnv(name)
+		if !ok || v == "" {
+			return
+		}
+		if err := apply(v); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+
+	env("GO_STREAM_PORT", func(v string) (err error) {
+		cfg.Port, err = strconv.Atoi(v)
+		return
+	})
+	env("GO_STREAM_DATA", func(v string) error {
+		cfg.Manager.DataDir = v
+		return nil
+	})
+	env("GO_STREAM_MAX_DISK", func(v string) (err error) {
+		n, err := parseByteSize(v)
+		cfg.Manager.MaxDisk = ByteSize(n)
+		return
+	})
+	env("GO_STREAM_METADATA_TIMEOUT", func(v string) (err error) {
+		d, err := time.ParseDuration(v)
+		cfg.Manager.MetadataTimeout = Duration(d)
+		return
+	})
+	env("GO_STREAM_BUFFER_TARGET", func(v string) (err error) {
+		d, err := time.ParseDuration(v)
+		cfg.Manager.BufferTarget = Duration(d)
+		return
+	})
+	env("GO_STREAM_CLEANUP_INTERVAL", func(v string) (err error) {
+		d, err := time.ParseDuration(v)
+		cfg.Manager.CleanupInterval = Duration(d)
+		return
+	})
+	env("GO_STREAM_CLEANUP_MAX_AGE", func(v string) (err error) {
+		d, err := time.ParseDuration(v)
+		cfg.Manager.CleanupMaxAge = Duration(d)
+		return
+	})
+	env("GO_STREAM_QUOTA_INTERVAL", func(v string) (err error) {
+		d, err := time.ParseDuration(v)
+		cfg.Manager.QuotaInterval = Duration(d)
+		return
+	})
+	env("GO_STREAM_SEED", func(v string) (err error) {
+		cfg.Manager.Seed, err = strconv.ParseBool(v)
+		return
+	})
+	env("GO_STREAM_LISTEN_PORT", func(v string) (err error) {
+		cfg.Manager.ListenPort, err = strconv.Atoi(v)
+		return
+	})
+	env("OPENSUBTITLES_API_KEY", func(v string) error {
+		cfg.OpenSubtitlesAPIKey = v
+		return nil
+	})
+	env("OPENSUBTITLES_USERNAME", func(v string) error {
+		cfg.OpenSubtitlesUsername = v
+		return nil
+	})
+	env("OPENSUBTITLES_PASSWORD", func(v string) error {
+		cfg.OpenSubtitlesPassword = v
+		return nil
+	})
+	env("OPENSUBTITLES_BASE_URL", func(v string) error {
+		cfg.OpenSubtitlesBaseURL = v
+		return nil
+	})
+	env("GO_STREAM_SUBTITLES_DIR", func(v string) error {
+		cfg.SubtitlesDir = v
+		return nil
+	})
+
+	return errors.Join(errs...)
+}
+
+func (c Config) Validate() error {
+	var errs []error
+	if c.Port < 1 || c.Port > 65535 {
+		errs = append(errs, fmt.Errorf("port: %d is not between 1 and 65535", c.Port))
+	}
+	if u, err := url.Parse(c.OpenSubtitlesBaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("openSubtitlesBaseUrl: %q is not an http(s) URL", c.OpenSubtitlesBaseURL))
+	}
+	if (c.OpenSubtitlesUsername == "") != (c.OpenSubtitlesPassword == "") {
+		errs = append(errs, fmt.Errorf("openSubtitlesUsername: username and password must be set together"))
+	}
+	if c.SubtitleCache.SearchTTL < 0 {
+		errs = append(errs, fmt.Errorf("subtitleCache.searchTtl: must not be negative"))
+	}
+	if c.SubtitleCache.MaxSize < 0 {
+		errs = append(errs, fmt.Errorf("subtitleCache.maxSize: must not be negative"))
+	}
+	if err := c.Manager.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+func (c TorrentManagerConfig) Validate() error {
+	var errs []error
+	fail := func(field, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("manager.%s: %s", field, fmt.Sprintf(format, args...)))
+	}
+
+	if strings.TrimSpace(c.DataDir) == "" {
+		fail("dataDir", "must not be empty")
+	}
+	if c.MaxDisk < 0 {
+		fail("maxDisk", "must not be negative")
+	}
+	if c.MetadataTimeout <= 0 {
+		fail("metadataTimeout", "must be positive")
+	}
+	if c.BufferTarget < 0 {
+		fail("bufferTarget", "must not be negative")
+	}
+	if c.CleanupInterval <= 0 {
+		fail("cleanupInterval", "must be positive")
+	}
+	if c.CleanupMaxAge <= 0 {
+		fail("cleanupMaxAge", "must be positive")
+	}
+	if c.QuotaInterval <= 0 {
+		fail("quotaInterval", "must be positive")
+	}
+	if c.ListenPort < 0 || c.ListenPort > 65535 {
+		fail("listenPort", "%d is not between 0 and 65535", c.ListenPort)
+	}
+
+	if len(c.Readahead) == 0 {
+		fail("readahead", "at least one tier is required")
+	} else if c.Readahead[0].MinFileSize != 0 {
+		fail("readahead", "first tier must have minFileSize 0")
+	}
+	for i, tier := range c.Readahead {
+		if tier.Readahead <= 0 {
+			fail(fmt.Sprintf("readahead[%d].readahead", i), "must be positive")
+		}
+		if i > 0 && tier.MinFileSize <= c.Readahead[i-1].MinFileSize {
+			fail(fmt.Sprintf("readahead[%d].minFileSize", i), "tiers must be in increasing minFileSize order")
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// readaheadFor returns the readahead of the largest tier fileSize reaches.
+func (c TorrentManagerConfig) readaheadFor(fileSize int64) int64 {
+	var readahead ByteSize
+	for _, tier := range c.Readahead {
+		if fileSize >= int64(tier.MinFileSize) {
+			readahead = tier.Readahead
+		}
+	}
+	return int64(readahead)
+}
+
+// Duration is a time.Duration written as a Go duration string ("90s") in
+// JSON.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"90s\", got %s", b)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// ByteSize is a byte count written in JSON either as a number or as a string
+// such as "500MB".
+type ByteSize int64
+
+func (b *ByteSize) UnmarshalJSON(data []byte) error {
+	var n int64
+	if err := json.Unmarshal(data, &n); err == nil {
+		*b = ByteSize(n)
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("size must be a number or a string like \"500MB\", got %s", data)
+	}
+	n, err := parseByteSize(s)
+	if err != nil {
+		return err
+	}
+	*b = ByteSize(n)
+	return nil
+}
+
+// parseByteSize parses sizes such as "500MB", "1.5G" or "1073741824" using
+// binary multiples. An empty string means zero.
+func parseByteSize(input string) (int64, error) {
+	s := strings.TrimSpace(strings.ToUpper(input))
+	if s == "" {
+		return 0, nil
+	}
+
+	units := []struct {
+		suffix string
+		mult   float64
+	}{
+		{"TIB", 1 << 40}, {"GIB", 1 << 30}, {"MIB", 1 << 20}, {"KIB", 1 << 10},
+		{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10},
+		{"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10},
+		{"B", 1},
+	}
+	mult := 1.0
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, u.suffix))
+			mult = u.mult
+			break
+		}
+	}
+
+	// ParseFloat accepts NaN, Inf and huge exponents, none of which convert
+	// to an int64
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 || math.IsNaN(n) || math.IsInf(n, 0) || n*mult >= math.MaxInt64 {
+		return 0, fmt.Errorf("invalid size %q", input)
+	}
+	return int64(n * mult), nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{in: "", want: 0},
+		{in: "1024", want: 1024},
+		{in: "16MB", want: 16 << 20},
+		{in: "1.5g", want: 3 << 29},
+		{in: "2 GiB", want: 2 << 30},
+		{in: "12XB", wantErr: true},
+		{in: "-1GB", wantErr: true},
+		{in: "NaN", wantErr: true},
+		{in: "Inf", wantErr: true},
+		{in: "-inf", wantErr: true},
+		{in: "1e30", wantErr: true},
+		{in: "8388608TB", wantErr: true},
+		{in: "8388607TB", want: 8388607 << 40},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseByteSize(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseByteSize(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseByteSize(%q) = %d, want %d", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	data := `{
+		"port": 9090,
+		"manager": {
+			"maxDisk": "50GB",
+			"metadataTimeout": "2m",
+			"readahead": [{"minFileSize": 0, "readahead": "8MB"}, {"minFileSize": "1GB", "readahead": "48MB"}]
+		}
+	}`
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := DefaultConfig()
+	if err := LoadConfigFile(path, &cfg); err != nil {
+		t.Fatalf("LoadConfigFile: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+
+	if cfg.Port != 9090 {
+		t.Errorf("Port = %d, want 9090", cfg.Port)
+	}
+	if cfg.Manager.MaxDisk != 50<<30 {
+		t.Errorf("MaxDisk = %d, want %d", cfg.Manager.MaxDisk, int64(50<<30))
+	}
+	if time.Duration(cfg.Manager.MetadataTimeout) != 2*time.Minute {
+		t.Errorf("MetadataTimeout = %v, want 2m", time.Duration(cfg.Manager.MetadataTimeout))
+	}
+	if cfg.Manager.DataDir != "/tmp/go-stream" {
+		t.Errorf("DataDir = %q, want default kept", cfg.Manager.DataDir)
+	}
+	if got := cfg.Manager.readaheadFor(3 << 30); got != 48<<20 {
+		t.Errorf("readaheadFor(3GB) = %d, want %d", got, 48<<20)
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	t.Setenv("GO_STREAM_PORT", "9091")
+	t.Setenv("GO_STREAM_CLEANUP_INTERVAL", "30m")
+	t.Setenv("GO_STREAM_QUOTA_INTERVAL", "15s")
+
+	cfg := DefaultConfig()
+	if err := ApplyEnv(&cfg); err != nil {
+		t.Fatalf("ApplyEnv: %v", err)
+	}
+	if cfg.Port != 9091 {
+		t.Errorf("Port = %d, want 9091", cfg.Port)
+	}
+	if time.Duration(cfg.Manager.CleanupInterval) != 30*time.Minute {
+		t.Errorf("CleanupInterval = %v, want 30m", time.Duration(cfg.Manager.CleanupInterval))
+	}
+	if time.Duration(cfg.Manager.QuotaInterval) != 15*time.Second {
+		t.Errorf("QuotaInterval = %v, want 15s", time.Duration(cfg.Manager.QuotaInterval))
+	}
+
+	t.Setenv("GO_STREAM_QUOTA_INTERVAL", "soon")
+	if err := ApplyEnv(&cfg); err == nil || !strings.Contains(err.Error(), "GO_STREAM_QUOTA_INTERVAL") {
+		t.Errorf("ApplyEnv with a bad interval = %v, want an error naming it", err)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Port = 70000
+	cfg.OpenSubtitlesBaseURL = "api.opensubtitles.com"
+	cfg.Manager.MetadataTimeout = 0
+	cfg.Manager.BufferTarget = Duration(-time.Second)
+	cfg.Manager.Readahead = []ReadaheadTier{{MinFileSize: 0, Readahead: 1 << 20}, {MinFileSize: 0, Readahead: 0}}
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("Validate() = nil, want errors")
+	}
+	for _, want := range []string{"port", "openSubtitlesBaseUrl", "manager.metadataTimeout", "manager.bufferTarget", "manager.readahead[1].readahead", "manager.readahead[1].minFileSize"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Validate() error %q does not mention %s", err, want)
+		}
+	}
+}
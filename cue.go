@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Cue is a single timed piece of subtitle text.
+type Cue struct {
+	ID         string // optional WebVTT cue identifier
+	Start, End int    // milliseconds
+	Settings   string // WebVTT cue settings, e.g. "align:start line:0"
+	Text       string // lines separated by "\n", may contain WebVTT tags
+}
+
+// Track is a subtitle document as an ordered list of cues.
+type Track struct {
+	Cues []Cue
+}
+
+// ParseError reports malformed subtitle input at a 1-based line number.
+type ParseError struct {
+	Line int
+	Msg  string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+var (
+	// SRT timestamps in the wild drop leading zeros, shorten the fraction
+	// or use '.' or ':' instead of ','; all of these are accepted.
+	srtTimestamp = regexp.MustCompile(`^(?:(\d+):)?(\d{1,2}):(\d{1,2})(?:[,.:](\d{1,3}))?$`)
+	vttStrictTS  = regexp.MustCompile(`^(?:(\d+):)?(\d{2}):(\d{2})\.(\d{3})$`)
+)
+
+// ParseSRT parses SubRip content. Cues that cannot be parsed are skipped and
+// reported in the returned error, so the track holds every valid cue even
+// when err is non-nil.
+func ParseSRT(data []byte) (*Track, error) {
+	lines := splitSubtitleLines(data)
+	track := &Track{}
+
+	var (
+		errs []error
+		cur  *Cue
+		text []string
+		skip bool // inside a cue whose timing line was rejected
+	)
+	flush := func() {
+		if cur != nil {
+			cur.Text = joinCueText(text)
+			track.Cues = append(track.Cues, *cur)
+		}
+		cur, text = nil, nil
+	}
+
+	for i, line := range lines {
+		lineNo := i + 1
+		trimmed := strings.TrimSpace(line)
+
+		if !strings.Contains(trimmed, "-->") {
+			switch {
+			case cur != nil:
+				text = append(text, strings.TrimRight(line, " \t"))
+			case trimmed != "" && !skip && !isDigitsOnly(trimmed):
+				errs = append(errs, &ParseError{Line: lineNo, Msg: "text outside of a cue"})
+			}
+			continue
+		}
+
+		// A number right before a timing line is the next cue's index, not
+		// text of the current cue.
+		for len(text) > 0 && strings.TrimSpace(text[len(text)-1]) == "" {
+			text = text[:len(text)-1]
+		}
+		if n := len(text); n > 0 && isDigitsOnly(strings.TrimSpace(text[n-1])) {
+			text = text[:n-1]
+		}
+		flush()
+		skip = true
+
+		startStr, rest, _ := strings.Cut(trimmed, "-->")
+		endStr := ""
+		if fields := strings.Fields(rest); len(fields) > 0 {
+			endStr = fields[0] // SRT coordinates after the end time are dropped
+		}
+		start, err := parseSRTTime(strings.TrimSpace(startStr))
+		if err != nil {
+			errs = append(errs, &ParseError{Line: lineNo, Msg: "start time: " + err.Error()})
+			continue
+		}
+		end, err := parseSRTTime(endStr)
+		if err != nil {
+			errs = append(errs, &ParseError{Line: lineNo, Msg: "end time: " + err.Error()})
+			continue
+		}
+		if end < start {
+			errs = append(errs, &ParseError{Line: lineNo, Msg: "cue ends before it starts"})
+			continue
+		}
+		cur, skip = &Cue{Start: start, End: end}, false
+	}
+	flush()
+
+	return track, errors.Join(errs...)
+}
+
+// ParseVTT parses WebVTT content. NOTE, STYLE and REGION blocks are skipped.
+// As with ParseSRT, invalid cues are reported in err but do not stop parsing.
+func ParseVTT(data []byte) (*Track, error) {
+	lines := splitSubtitleLines(data)
+	track := &Track{}
+
+	if len(lines) == 0 || !isVTTHeader(lines[0]) {
+		return track, &ParseError{Line: 1, Msg: "missing WEBVTT header"}
+	}
+
+	var errs []error
+	i := 1
+	// The header block runs until the first blank line
+	for i < len(lines) && strings.TrimSpace(lines[i]) != "" {
+		i++
+	}
+
+	for i < len(lines) {
+		if strings.TrimSpace(lines[i]) == "" {
+			i++
+			continue
+		}
+		blockStart := i
+		for i < len(lines) && strings.TrimSpace(lines[i]) != "" {
+			i++
+		}
+		block := lines[blockStart:i]
+
+		if kw, _, _ := strings.Cut(strings.TrimSpace(block[0]), " "); kw == "NOTE" || kw == "STYLE" || kw == "REGION" {
+			continue
+		}
+
+		var cue Cue
+		timing := 0
+		if !strings.Contains(block[0], "-->") {
+			if len(block) < 2 || !strings.Contains(block[1], "-->") {
+				errs = append(errs, &ParseError{Line: blockStart + 1, Msg: "expected cue timing"})
+				continue
+			}
+			cue.ID = strings.TrimSpace(block[0])
+			timing = 1
+		}
+		lineNo := blockStart + timing + 1
+
+		startStr, rest, _ := strings.Cut(block[timing], "-->")
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			errs = append(errs, &ParseError{Line: lineNo, Msg: "end time: missing"})
+			continue
+		}
+		var err error
+		if cue.Start, err = parseVTTTime(strings.TrimSpace(startStr)); err != nil {
+			errs = append(errs, &ParseError{Line: lineNo, Msg: "start time: " + err.Error()})
+			continue
+		}
+		if cue.End, err = parseVTTTime(fields[0]); err != nil {
+			errs = append(errs, &ParseError{Line: lineNo, Msg: "end time: " + err.Error()})
+			continue
+		}
+		if cue.End < cue.Start {
+			errs = append(errs, &ParseError{Line: lineNo, Msg: "cue ends before it starts"})
+			continue
+		}
+		cue.Settings = strings.Join(fields[1:], " ")
+		cue.Text = joinCueText(block[timing+1:])
+		track.Cues = append(track.Cues, cue)
+	}
+
+	return track, errors.Join(errs...)
+}
+
+// VTT renders the track as a WebVTT document. Cues are written in start
+// time order, which WebVTT requires; overlapping cues are kept and shown
+// together by players.
+func (t *Track) VTT() []byte {
+	cues := make([]Cue, len(t.Cues))
+	copy(cues, t.Cues)
+	sort.SliceStable(cues, func(i, j int) bool { return cues[i].Start < cues[j].Start })
+
+	var buf bytes.Buffer
+	buf.WriteString("WEBVTT\n\n")
+	for i, c := range cues {
+		if i > 0 {
+			buf.WriteByte('\n')
+		}
+		if id := strings.ReplaceAll(c.ID, "-->", "--&gt;"); id != "" {
+			buf.WriteString(id)
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(formatVTTTime(c.Start))
+		buf.WriteString(" --> ")
+		buf.WriteString(formatVTTTime(c.End))
+		if c.Settings != "" {
+			buf.WriteByte(' ')
+			buf.WriteString(c.Settings)
+		}
+		buf.WriteByte('\n')
+		// Cue text may not contain "-->" or blank lines
+		if text := joinCueText(strings.Split(strings.ReplaceAll(c.Text, "-->", "--&gt;"), "\n")); text != "" {
+			buf.WriteString(text)
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Bytes()
+}
+
+// splitSubtitleLines strips a UTF-8 BOM and splits on any newline style.
+func splitSubtitleLines(data []byte) []string {
+	s := string(bytes.TrimPrefix(data, []byte("\xEF\xBB\xBF")))
+	s = strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(s)
+	s = strings.TrimRight(s, "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+// joinCueText joins cue lines, dropping blank ones.
+func joinCueText(lines []string) string {
+	kept := make([]string, 0, len(lines))
+	for _, l := range lines {
+		if strings.TrimSpace(l) != "" {
+			kept = append(kept, l)
+		}
+	}
+	return strings.Join(kept, "\n")
+}
+
+func isVTTHeader(line string) bool {
+	line = strings.TrimPrefix(line, "\xEF\xBB\xBF")
+	return line == "WEBVTT" || strings.HasPrefix(line, "WEBVTT ") || strings.HasPrefix(line, "WEBVTT\t")
+}
+
+func parseSRTTime(s string) (int, error) {
+	m := srtTimestamp.FindStringSubmatch(s)
+	if m == nil {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+	frac := 0
+	if m[4] != "" {
+		// Scale the fraction to milliseconds: ",5" is 500ms
+		frac, _ = strconv.Atoi((m[4] + "00")[:3])
+	}
+	return timestampMillis(s, m[1], m[2], m[3], frac)
+}
+
+func parseVTTTime(s string) (int, error) {
+	m := vttStrictTS.FindStringSubmatch(s)
+	if m == nil {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+	frac, _ := strconv.Atoi(m[4])
+	return timestampMillis(s, m[1], m[2], m[3], frac)
+}
+
+func timestampMillis(s, hours, minutes, seconds string, frac int) (int, error) {
+	h := 0
+	if hours != "" {
+		var err error
+		if h, err = strconv.Atoi(hours); err != nil || h > 999 {
+			return 0, fmt.Errorf("invalid timestamp %q", s)
+		}
+	}
+	m, _ := strconv.Atoi(minutes)
+	sec, _ := strconv.Atoi(seconds)
+	if m > 59 || sec > 59 {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+	return ((h*60+m)*60+sec)*1000 + frac, nil
+}
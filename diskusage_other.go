@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// allocatedSize reports the bytes a file occupies on disk.
+func allocatedSize(info os.FileInfo) int64 {
+	return info.Size()
+}
@@ -0,0 +1,63 @@
+package main
+
+import "sync"
+
+// Lifecycle event types published by the TorrentManager.
+const (
+	EventMetadataReceived = "metadata_received"
+	EventMetadataFailed   = "metadata_failed"
+	EventFileSelected     = "file_selected"
+	EventSubtitleAdded    = "subtitle_added"
+	EventReadyToPlay      = "ready_to_play"
+	EventTorrentRemoved   = "torrent_removed"
+)
+
+// TorrentEvent is a lifecycle notification for a single torrent.
+type TorrentEvent struct {
+	Type      string      `json:"type"`
+	TorrentID string      `json:"torrentId"`
+	Data      interface{} `json:"data,omitempty"`
+}
+
+// eventHub fans lifecycle events out to per-torrent subscribers. Slow
+// subscribers miss events rather than blocking the manager.
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[string]map[chan TorrentEvent]struct{}
+}
+
+func (h *eventHub) subscribe(torrentID string) (<-chan TorrentEvent, func()) {
+	ch := make(chan TorrentEvent, 16)
+
+	h.mu.Lock()
+	if h.subs == nil {
+		h.subs = make(map[string]map[chan TorrentEvent]struct{})
+	}
+	if h.subs[torrentID] == nil {
+		h.subs[torrentID] = make(map[chan TorrentEvent]struct{})
+	}
+	h.subs[torrentID][ch] = struct{}{}
+	h.mu.Unlock()
+
+	unsubscribe := func() {
+		h.mu.Lock()
+		delete(h.subs[torrentID], ch)
+		if len(h.subs[torrentID]) == 0 {
+			delete(h.subs, torrentID)
+		}
+		h.mu.Unlock()
+	}
+	return ch, unsubscribe
+}
+
+func (h *eventHub) publish(ev TorrentEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.subs[ev.TorrentID] {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
@@ -1,16 +1,24 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
+
+	"github.com/anacrolix/torrent"
 )
 
 type APIResponse struct {
@@ -44,15 +52,111 @@ func handleIndex(tmpl *template.Template) http.HandlerFunc {
 	}
 }
 
+type subtitleEntry struct {
+	Name      string `json:"name"`
+	URL       string `json:"url"`
+	FileIndex int    `json:"fileIndex"` // the video it belongs to, -1 for any
+	Encoding  string `json:"encoding,omitempty"`
+	Language  string `json:"language,omitempty"`
+}
+
+type fileDetail struct {
+	FileInfo
+	Completed int64 `json:"completed"`
+}
+
+type torrentDetail struct {
+	ID           string          `json:"id"`
+	Name         string          `json:"name"`
+	State        string          `json:"state"`
+	Error        string          `json:"error,omitempty"`
+	Files        []fileDetail    `json:"files"`
+	SelectedFile int             `json:"selectedFile"`
+	ReadyToPlay  bool            `json:"readyToPlay"`
+	Subtitles    []subtitleEntry `json:"subtitles"`
+	LastAccessed time.Time       `json:"lastAccessed"`
+	Peers        int             `json:"peers"`
+	Seeders      int             `json:"seeders"`
+	DownloadRate float64         `json:"downloadRate"`
+	UploadRate   float64         `json:"uploadRate"`
+	Streams      []StreamStatus  `json:"streams"`
+	Playlists    []Playlist      `json:"playlists"`
+	NextFile     int             `json:"nextFile"`
+}
+
+func subtitleEntries(torrentID string, subs []SubtitleInfo) []subtitleEntry {
+	entries := make([]subtitleEntry, 0, len(subs))
+	for _, s := range subs {
+		entries = append(entries, subtitleEntry{
+			Name:      s.Name,
+			URL:       fmt.Sprintf("/subs/%s/%d", torrentID, s.Index),
+			FileIndex: s.FileIndex,
+			Encoding:  s.Encoding,
+			Language:  s.Language,
+		})
+	}
+	return entries
+}
+
+func torrentDetailOf(mt *ManagedTorrent) torrentDetail {
+	stats := mt.Torrent.Stats()
+
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	d := torrentDetail{
+		ID:           mt.ID,
+		Name:         mt.Name,
+		State:        mt.State,
+		Error:        mt.Error,
+		Files:        make([]fileDetail, 0, len(mt.Files)),
+		SelectedFile: mt.SelectedFile,
+		ReadyToPlay:  mt.readyToPlay,
+		Subtitles:    subtitleEntries(mt.ID, mt.Subtitles),
+		LastAccessed: mt.LastAccessed,
+		Peers:        stats.ActivePeers,
+		Seeders:      stats.ConnectedSeeders,
+		DownloadRate: mt.rate.Down,
+		UploadRate:   mt.rate.Up,
+		Streams:      mt.streamStatuses(),
+		Playlists:    []Playlist{},
+		NextFile:     -1,
+	}
+	if mt.State == StateReady {
+		if playlists := buildPlaylists(mt.Files); playlists != nil {
+			d.Playlists = playlists
+		}
+		if next, ok := nextEpisode(d.Playlists, mt.SelectedFile); ok {
+			d.NextFile = next
+		}
+		torrentFiles := mt.Torrent.Files()
+		for i, fi := range mt.Files {
+			d.Files = append(d.Files, fileDetail{
+				FileInfo:  fi,
+				Completed: torrentFiles[i].BytesCompleted(),
+			})
+		}
+	}
+	return d
+}
+
+// writeAddResult reports the outcome of adding a torrent.
+func writeAddResult(w http.ResponseWriter, mt *ManagedTorrent, err error) {
+	if err != nil {
+		if strings.Contains(err.Error(), "invalid") {
+			jsonError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		jsonError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	jsonOK(w, torrentDetailOf(mt))
+}
+
 func handleAddMagnet(manager *TorrentManager) http.HandlerFunc {
 	type request struct {
 		Magnet string `json:"magnet"`
 	}
-	type response struct {
-		ID    string     `json:"id"`
-		Name  string     `json:"name"`
-		Files []FileInfo `json:"files"`
-	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req request
@@ -65,21 +169,290 @@ func handleAddMagnet(manager *TorrentManager) http.HandlerFunc {
 			return
 		}
 
-		mt, err := manager.AddMagnet(r.Context(), req.Magnet)
+		mt, err := manager.AddMagnet(req.Magnet)
+		writeAddResult(w, mt, err)
+	}
+}
+
+// errBlockedAddress is returned when a torrent URL leads to an address that
+// is not on the public internet.
+var errBlockedAddress = errors.New("torrent URL must point to a public address")
+
+// publicDialer dials only public addresses, so clients can't use torrent
+// URLs, or redirects from them, to reach the server's own network.
+var publicDialer = &net.Dialer{
+	Timeout: 10 * time.Second,
+	Control: func(network, address string, _ syscall.RawConn) error {
+		addr, err := netip.ParseAddrPort(address)
+		if err != nil || !isPublicAddr(addr.Addr()) {
+			return errBlockedAddress
+		}
+		return nil
+	},
+}
+
+// reservedPrefixes are special-purpose ranges not covered by the netip
+// predicates, which can still route to internal hosts.
+var reservedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),     // "this" network
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),  // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"), // benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),   // reserved, and broadcast
+}
+
+// isPublicAddr reports whether addr is outside the loopback, private,
+// link-local, unspecified and reserved ranges.
+func isPublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() ||
+		addr.IsLinkLocalMulticast() || addr.IsInterfaceLocalMulticast() || addr.IsUnspecified() {
+		return false
+	}
+	for _, p := range reservedPrefixes {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// handleAddTorrent accepts either a multipart upload of a .torrent file or a
+// JSON body with the HTTP(S) URL of one.
+func handleAddTorrent(manager *TorrentManager) http.HandlerFunc {
+	const maxTorrentSize = 10 << 20 // 10MB
+
+	type request struct {
+		URL string `json:"url"`
+	}
+
+	fetchClient := &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{DialContext: publicDialer.DialContext},
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+			r.Body = http.MaxBytesReader(w, r.Body, maxTorrentSize)
+			if err := r.ParseMultipartForm(maxTorrentSize); err != nil {
+				jsonError(w, "file too large (max 10MB)", http.StatusRequestEntityTooLarge)
+				return
+			}
+
+			file, _, err := r.FormFile("torrent")
+			if err != nil {
+				jsonError(w, "torrent file required", http.StatusBadRequest)
+				return
+			}
+			defer file.Close()
+
+			mt, err := manager.AddTorrentFile(io.LimitReader(file, maxTorrentSize))
+			writeAddResult(w, mt, err)
+			return
+		}
+
+		var req request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			jsonError(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+		u, err := url.Parse(req.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			jsonError(w, "an http(s) torrent URL is required", http.StatusBadRequest)
+			return
+		}
+
+		fetchReq, err := http.NewRequestWithContext(r.Context(), "GET", u.String(), nil)
+		if err != nil {
+			jsonError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := fetchClient.Do(fetchReq)
+		if errors.Is(err, errBlockedAddress) {
+			jsonError(w, errBlockedAddress.Error(), http.StatusBadRequest)
+			return
+		}
 		if err != nil {
-			if strings.Contains(err.Error(), "timeout") {
-				jsonError(w, "metadata timeout — no peers found", http.StatusGatewayTimeout)
+			jsonError(w, fmt.Sprintf("fetch torrent: %v", err), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			jsonError(w, fmt.Sprintf("fetch torrent: remote returned %d", resp.StatusCode), http.StatusBadGateway)
+			return
+		}
+
+		mt, err := manager.AddTorrentFile(io.LimitReader(resp.Body, maxTorrentSize))
+		writeAddResult(w, mt, err)
+	}
+}
+
+func handleListTorrents(manager *TorrentManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		all := manager.List()
+		details := make([]torrentDetail, 0, len(all))
+		for _, mt := range all {
+			details = append(details, torrentDetailOf(mt))
+		}
+		jsonOK(w, details)
+	}
+}
+
+func handleGetTorrent(manager *TorrentManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mt, ok := manager.peek(r.PathValue("id"))
+		if !ok {
+			jsonError(w, "torrent not found", http.StatusNotFound)
+			return
+		}
+		jsonOK(w, torrentDetailOf(mt))
+	}
+}
+
+func handleFilePieces(manager *TorrentManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fileIndex, err := strconv.Atoi(r.PathValue("index"))
+		if err != nil {
+			jsonError(w, "invalid file index", http.StatusBadRequest)
+			return
+		}
+
+		pieces, err := manager.FilePieces(r.PathValue("id"), fileIndex)
+		if err != nil {
+			if strings.Contains(err.Error(), "not found") {
+				jsonError(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			jsonError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		jsonOK(w, pieces)
+	}
+}
+
+func handleRemoveTorrent(manager *TorrentManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mt, ok := manager.GetTorrent(r.PathValue("id"))
+		if !ok {
+			jsonError(w, "torrent not found", http.StatusNotFound)
+			return
+		}
+
+		deleteData, _ := strconv.ParseBool(r.URL.Query().Get("deleteData"))
+		if err := manager.RemoveTorrent(mt.ID, deleteData); err != nil {
+			if strings.Contains(err.Error(), "not found") {
+				jsonError(w, err.Error(), http.StatusNotFound)
 				return
 			}
 			jsonError(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		jsonOK(w, "torrent removed")
+	}
+}
 
-		mt.mu.Lock()
-		resp := response{ID: mt.ID, Name: mt.Name, Files: mt.Files}
-		mt.mu.Unlock()
+// handleTorrentEvents streams progress snapshots and lifecycle events for a
+// torrent as Server-Sent Events.
+func handleTorrentEvents(manager *TorrentManager) http.HandlerFunc {
+	const snapshotInterval = time.Second
+
+	type snapshot struct {
+		State         string       `json:"state"`
+		SelectedFile  int          `json:"selectedFile"`
+		ReadyToPlay   bool         `json:"readyToPlay"`
+		FileCompleted int64        `json:"fileCompleted"`
+		FileLength    int64        `json:"fileLength"`
+		DownloadRate  float64      `json:"downloadRate"`
+		UploadRate    float64      `json:"uploadRate"`
+		Peers         int          `json:"peers"`
+		NewPieces     []pieceRange `json:"newPieces,omitempty"`
+	}
 
-		jsonOK(w, resp)
+	return func(w http.ResponseWriter, r *http.Request) {
+		mt, ok := manager.peek(r.PathValue("id"))
+		if !ok {
+			jsonError(w, "torrent not found", http.StatusNotFound)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			jsonError(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+
+		events, unsubscribe := manager.Subscribe(mt.ID)
+		defer unsubscribe()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+
+		send := func(event string, data interface{}) bool {
+			payload, err := json.Marshal(data)
+			if err != nil {
+				log.Printf("sse encode error: %v", err)
+				return false
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload); err != nil {
+				return false
+			}
+			flusher.Flush()
+			return true
+		}
+
+		// The first snapshot reports every completed piece; later ones only
+		// the pieces completed since the previous snapshot.
+		var pieces []bool
+		sendSnapshot := func() bool {
+			stats := mt.Torrent.Stats()
+
+			mt.mu.Lock()
+			snap := snapshot{
+				State:        mt.State,
+				SelectedFile: mt.SelectedFile,
+				ReadyToPlay:  mt.readyToPlay,
+				DownloadRate: mt.rate.Down,
+				UploadRate:   mt.rate.Up,
+				Peers:        stats.ActivePeers,
+			}
+			ready := mt.State == StateReady
+			if ready && mt.SelectedFile >= 0 {
+				f := mt.Torrent.Files()[mt.SelectedFile]
+				snap.FileCompleted = f.BytesCompleted()
+				snap.FileLength = f.Length()
+			}
+			mt.mu.Unlock()
+
+			if ready {
+				cur := completedPieces(mt.Torrent)
+				snap.NewPieces = newPieceRanges(pieces, cur)
+				pieces = cur
+			}
+			return send("progress", snap)
+		}
+
+		ticker := time.NewTicker(snapshotInterval)
+		defer ticker.Stop()
+
+		if !sendSnapshot() {
+			return
+		}
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case ev := <-events:
+				if !send(ev.Type, ev) || ev.Type == EventTorrentRemoved {
+					return
+				}
+			case <-ticker.C:
+				if !sendSnapshot() {
+					return
+				}
+			}
+		}
 	}
 }
 
@@ -87,16 +460,13 @@ func handleSelectFile(manager *TorrentManager) http.HandlerFunc {
 	type request struct {
 		FileIndex int `json:"fileIndex"`
 	}
-	type subtitleEntry struct {
-		Name string `json:"name"`
-		URL  string `json:"url"`
-	}
 	type response struct {
 		StreamURL string          `json:"streamUrl"`
 		Subtitles []subtitleEntry `json:"subtitles"`
 		IsImage   bool            `json:"isImage"`
 		FileIndex int             `json:"fileIndex"`
 		FileName  string          `json:"fileName"`
+		NextFile  int             `json:"nextFile"`
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -123,23 +493,22 @@ func handleSelectFile(manager *TorrentManager) http.HandlerFunc {
 		}
 
 		mt.mu.Lock()
-		var subs []subtitleEntry
-		for _, s := range mt.Subtitles {
-			subs = append(subs, subtitleEntry{
-				Name: s.Name,
-				URL:  fmt.Sprintf("/subs/%s/%d", torrentID, s.Index),
-			})
-		}
+		subs := subtitleEntries(torrentID, mt.subtitlesFor(req.FileIndex))
 		isImage := mt.Files[req.FileIndex].IsImage
 		fileName := filepath.Base(mt.Files[req.FileIndex].Path)
+		next, ok := nextEpisode(buildPlaylists(mt.Files), req.FileIndex)
 		mt.mu.Unlock()
+		if !ok {
+			next = -1
+		}
 
 		jsonOK(w, response{
-			StreamURL: "/stream/" + torrentID,
+			StreamURL: fmt.Sprintf("/stream/%s/%d", torrentID, req.FileIndex),
 			Subtitles: subs,
 			IsImage:   isImage,
 			FileIndex: req.FileIndex,
 			FileName:  fileName,
+			NextFile:  next,
 		})
 	}
 }
@@ -152,7 +521,21 @@ func handleStream(manager *TorrentManager) http.HandlerFunc {
 			return
 		}
 
-		reader, file, err := manager.GetFileReader(torrentID)
+		var (
+			reader torrent.Reader
+			file   *torrent.File
+			err    error
+		)
+		if fileIndexStr := r.PathValue("fileIndex"); fileIndexStr != "" {
+			fileIndex, convErr := strconv.Atoi(fileIndexStr)
+			if convErr != nil {
+				http.Error(w, "invalid file index", http.StatusBadRequest)
+				return
+			}
+			reader, file, err = manager.GetFileReader(torrentID, fileIndex)
+		} else {
+			reader, file, err = manager.GetSelectedFileReader(torrentID)
+		}
 		if err != nil {
 			if strings.Contains(err.Error(), "not found") {
 				http.Error(w, err.Error(), http.StatusNotFound)
@@ -243,6 +626,17 @@ func handleUploadSubtitle(manager *TorrentManager) http.HandlerFunc {
 		}
 		defer file.Close()
 
+		// MicroDVD files without a frame rate header are timed at fps, a
+		// form field or query parameter; 0 selects ConvertSUBtoVTT's default
+		var fps float64
+		if v := r.FormValue("fps"); v != "" {
+			fps, err = strconv.ParseFloat(v, 64)
+			if err != nil || !(fps > 0 && fps <= 1000) {
+				jsonError(w, "fps must be a positive number", http.StatusBadRequest)
+				return
+			}
+		}
+
 		content, err := io.ReadAll(io.LimitReader(file, maxUploadSize))
 		if err != nil {
 			jsonError(w, "failed to read file", http.StatusInternalServerError)
@@ -250,34 +644,37 @@ func handleUploadSubtitle(manager *TorrentManager) http.HandlerFunc {
 		}
 
 		name := header.Filename
-		ext := strings.ToLower(filepath.Ext(name))
-		if ext == ".srt" {
-			content = ConvertSRTtoVTT(content)
-			name = strings.TrimSuffix(name, filepath.Ext(name)) + ".vtt"
+		content, enc := decodeSubtitle(content)
+		if ext := strings.ToLower(filepath.Ext(name)); ext != ".vtt" {
+			content = subtitleToVTT(name, content, fps)
+			name = stripExt(name) + ".vtt"
 		}
 
-		mt.mu.Lock()
-		// Use negative indices for uploaded subtitles to avoid collision
-		uploadIndex := -(len(mt.Subtitles) + 1)
-		mt.Subtitles = append(mt.Subtitles, SubtitleInfo{
-			Name:    name,
-			Index:   uploadIndex,
-			Content: content,
-		})
-		mt.mu.Unlock()
+		sub := manager.AddSubtitle(mt, name, enc, content)
 
 		type response struct {
-			Name string `json:"name"`
-			URL  string `json:"url"`
+			Name     string `json:"name"`
+			URL      string `json:"url"`
+			Encoding string `json:"encoding"`
 		}
 		jsonOK(w, response{
-			Name: name,
-			URL:  fmt.Sprintf("/subs/%s/%d", torrentID, uploadIndex),
+			Name:     name,
+			URL:      fmt.Sprintf("/subs/%s/%d", torrentID, sub.Index),
+			Encoding: enc,
 		})
 	}
 }
 
-func handleSearchSubtitles(manager *TorrentManager, subClient *OpenSubClient) http.HandlerFunc {
+// movieHashTimeout caps how long hashing the selected file waits for the
+// pieces at both ends. It runs beyond the search that started it, so a later
+// search finds those pieces present.
+const movieHashTimeout = 10 * time.Second
+
+// movieHashBudget is how long a subtitle search waits for the movie hash
+// before searching without it.
+const movieHashBudget = 300 * time.Millisecond
+
+func handleSearchSubtitles(manager *TorrentManager, providers SubtitleProviders) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		torrentID := r.PathValue("torrentId")
 		if torrentID == "" {
@@ -291,24 +688,51 @@ func handleSearchSubtitles(manager *TorrentManager, subClient *OpenSubClient) ht
 			return
 		}
 
-		query := r.URL.Query().Get("query")
-		if query == "" {
-			// Default to torrent name or selected file name
+		lang := r.URL.Query().Get("lang")
+		if lang == "" {
+			lang = "en"
+		}
+
+		q := SubtitleQuery{Text: r.URL.Query().Get("query"), Lang: lang}
+		if q.Text == "" {
+			// Default to the title, season and episode of the selected file,
+			// or of the torrent if none is selected
 			mt.mu.Lock()
 			if mt.SelectedFile >= 0 && mt.SelectedFile < len(mt.Files) {
-				query = stripExt(filepath.Base(mt.Files[mt.SelectedFile].Path))
+				f := mt.Files[mt.SelectedFile]
+				media := mediaInfoFor(mt.Name, f.Path)
+				if f.Media != nil {
+					media = *f.Media
+				}
+				q = subtitleQueryFor(stripExt(filepath.Base(f.Path)), media, lang)
 			} else {
-				query = mt.Name
+				q = subtitleQueryFor(mt.Name, ParseRelease(mt.Name), lang)
 			}
 			mt.mu.Unlock()
 		}
-
-		lang := r.URL.Query().Get("lang")
-		if lang == "" {
-			lang = "en"
+		if _, ok := providers.Provider("opensubtitles"); ok {
+			// The hash waits on pieces at both ends of the file, so a slow
+			// swarm only gets movieHashBudget before the text search goes
+			// ahead without it
+			hashes := make(chan string, 1)
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), movieHashTimeout)
+				defer cancel()
+				hash, err := manager.MovieHash(ctx, torrentID)
+				if err != nil {
+					log.Printf("movie hash for %s: %v", torrentID, err)
+				}
+				hashes <- hash
+			}()
+			select {
+			case q.MovieHash = <-hashes:
+			case <-time.After(movieHashBudget):
+			case <-r.Context().Done():
+				return
+			}
 		}
 
-		results, err := subClient.Search(query, lang)
+		results, err := providers.Search(q)
 		if err != nil {
 			jsonError(w, err.Error(), http.StatusBadGateway)
 			return
@@ -318,9 +742,11 @@ func handleSearchSubtitles(manager *TorrentManager, subClient *OpenSubClient) ht
 	}
 }
 
-func handleDownloadSubtitle(manager *TorrentManager, subClient *OpenSubClient) http.HandlerFunc {
+func handleDownloadSubtitle(manager *TorrentManager, providers SubtitleProviders) http.HandlerFunc {
 	type request struct {
-		FileID int `json:"fileId"`
+		Provider string `json:"provider"`
+		ID       string `json:"id"`
+		FileID   int    `json:"fileId"` // OpenSubtitles file ID, for older clients
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -341,44 +767,132 @@ func handleDownloadSubtitle(manager *TorrentManager, subClient *OpenSubClient) h
 			jsonError(w, "invalid request body", http.StatusBadRequest)
 			return
 		}
-		if req.FileID == 0 {
-			jsonError(w, "fileId is required", http.StatusBadRequest)
+		if req.ID == "" && req.FileID != 0 {
+			req.Provider, req.ID = "opensubtitles", strconv.Itoa(req.FileID)
+		}
+		if req.Provider == "" || req.ID == "" {
+			jsonError(w, "provider and id are required", http.StatusBadRequest)
+			return
+		}
+		provider, ok := providers.Provider(req.Provider)
+		if !ok {
+			jsonError(w, "unknown subtitle provider: "+req.Provider, http.StatusBadRequest)
 			return
 		}
 
-		content, fileName, err := subClient.Download(req.FileID)
+		content, fileName, err := provider.Download(req.ID)
+		if errors.Is(err, errSubtitleQuota) {
+			jsonError(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
 		if err != nil {
 			jsonError(w, err.Error(), http.StatusBadGateway)
 			return
 		}
 
-		// Convert SRT to VTT if needed
-		ext := strings.ToLower(filepath.Ext(fileName))
-		if ext == ".srt" {
-			content = ConvertSRTtoVTT(content)
-			fileName = strings.TrimSuffix(fileName, filepath.Ext(fileName)) + ".vtt"
+		// Transcode to UTF-8, then convert SRT/ASS to VTT if needed
+		content, enc := decodeSubtitle(content)
+		if ext := strings.ToLower(filepath.Ext(fileName)); ext != ".vtt" {
+			content = subtitleToVTT(fileName, content, 0)
+			fileName = stripExt(fileName) + ".vtt"
 		}
 
-		mt.mu.Lock()
-		uploadIndex := -(len(mt.Subtitles) + 1)
-		mt.Subtitles = append(mt.Subtitles, SubtitleInfo{
-			Name:    fileName,
-			Index:   uploadIndex,
-			Content: content,
-		})
-		mt.mu.Unlock()
+		sub := manager.AddSubtitle(mt, fileName, enc, content)
+
+		type response struct {
+			Name     string         `json:"name"`
+			URL      string         `json:"url"`
+			Encoding string         `json:"encoding"`
+			Quota    *SubtitleQuota `json:"quota,omitempty"`
+		}
+		resp := response{
+			Name:     fileName,
+			URL:      fmt.Sprintf("/subs/%s/%d", torrentID, sub.Index),
+			Encoding: enc,
+		}
+		if qr, ok := provider.(SubtitleQuotaReporter); ok {
+			if quota, ok := qr.Quota(); ok {
+				resp.Quota = &quota
+			}
+		}
+		jsonOK(w, resp)
+	}
+}
+
+func handleShiftSubtitle(manager *TorrentManager) http.HandlerFunc {
+	type request struct {
+		OffsetMs int     `json:"offsetMs"`
+		FromFPS  float64 `json:"fromFps"`
+		ToFPS    float64 `json:"toFps"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		torrentID := r.PathValue("torrentId")
+		index, err := strconv.Atoi(r.PathValue("index"))
+		if err != nil {
+			jsonError(w, "invalid subtitle index", http.StatusBadRequest)
+			return
+		}
+
+		var req request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			jsonError(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		// The fps pair is optional but must be given together
+		ratio := 1.0
+		switch {
+		case req.FromFPS == 0 && req.ToFPS == 0:
+		case req.FromFPS <= 0 || req.ToFPS <= 0:
+			jsonError(w, "fromFps and toFps must both be positive", http.StatusBadRequest)
+			return
+		default:
+			ratio = req.FromFPS / req.ToFPS
+		}
+		if req.OffsetMs == 0 && ratio == 1 {
+			jsonError(w, "offsetMs or fromFps/toFps required", http.StatusBadRequest)
+			return
+		}
+
+		sub, err := manager.ShiftSubtitle(torrentID, index, req.OffsetMs, ratio)
+		if err != nil {
+			jsonError(w, err.Error(), http.StatusNotFound)
+			return
+		}
 
 		type response struct {
 			Name string `json:"name"`
 			URL  string `json:"url"`
 		}
 		jsonOK(w, response{
-			Name: fileName,
-			URL:  fmt.Sprintf("/subs/%s/%d", torrentID, uploadIndex),
+			Name: sub.Name,
+			URL:  fmt.Sprintf("/subs/%s/%d", torrentID, sub.Index),
 		})
 	}
 }
 
+func handleSubtitleCache(cache *SubtitleCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats, err := cache.Stats()
+		if err != nil {
+			jsonError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		jsonOK(w, stats)
+	}
+}
+
+func handlePurgeSubtitleCache(cache *SubtitleCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := cache.Purge(); err != nil {
+			jsonError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		jsonOK(w, "subtitle cache purged")
+	}
+}
+
 func handleCleanup(manager *TorrentManager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if err := manager.RemoveAll(); err != nil {
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsPublicAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1::1", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"192.168.0.10", false},
+		{"172.16.5.4", false},
+		{"fd00::1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"::ffff:127.0.0.1", false},
+		{"100.64.0.1", false},
+		{"100.127.255.254", false},
+		{"100.128.0.1", true},
+		{"192.0.0.8", false},
+		{"198.18.0.1", false},
+		{"198.19.255.255", false},
+		{"198.20.0.1", true},
+		{"240.0.0.1", false},
+		{"255.255.255.255", false},
+		{"0.1.2.3", false},
+		{"::ffff:100.64.0.1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			if got := isPublicAddr(netip.MustParseAddr(tt.addr)); got != tt.want {
+				t.Errorf("isPublicAddr(%s) = %v, want %v", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddTorrentURLRefusesLoopback(t *testing.T) {
+	fetched := false
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched = true
+	}))
+	defer local.Close()
+
+	m := newTestManager(t)
+	rec := httptest.NewRecorder()
+	body := strings.NewReader(`{"url":"` + local.URL + `/x.torrent"}`)
+	handleAddTorrent(m)(rec, httptest.NewRequest("POST", "/api/torrent", body))
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d; body %s", rec.Code, http.StatusBadRequest, rec.Body)
+	}
+	if fetched {
+		t.Error("the loopback server was requested")
+	}
+}
+
+func TestUploadSubtitleFPS(t *testing.T) {
+	m := newTestManager(t)
+	mt := addTestTorrent(t, m, 1<<16, testFile{path: "movie.mkv", length: 1 << 20})
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/subtitle/{torrentId}", handleUploadSubtitle(m))
+
+	upload := func(query string) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, err := mw.CreateFormFile("subtitle", "movie.sub")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte("{25}{50}One second\n"))
+		mw.Close()
+		req := httptest.NewRequest("POST", "/api/subtitle/"+mt.ID+query, &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := upload("?fps=25"); rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", rec.Code, rec.Body)
+	}
+	mt.mu.Lock()
+	got := string(mt.Subtitles[len(mt.Subtitles)-1].Content)
+	mt.mu.Unlock()
+	if want := "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nOne second\n"; got != want {
+		t.Errorf("content = %q, want %q", got, want)
+	}
+
+	for _, fps := range []string{"0", "-25", "NaN", "fast"} {
+		if rec := upload("?fps=" + fps); rec.Code != http.StatusBadRequest {
+			t.Errorf("fps=%s: status = %d, want %d", fps, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestStatusReadsDontTouchTorrent(t *testing.T) {
+	m := newTestManager(t)
+	mt := addTestTorrent(t, m, 1<<16, testFile{path: "movie.mkv", length: 1 << 20})
+	old := time.Now().Add(-48 * time.Hour)
+	mt.mu.Lock()
+	mt.LastAccessed = old
+	mt.mu.Unlock()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/torrents/{id}", handleGetTorrent(m))
+	mux.HandleFunc("GET /api/torrents/{id}/files/{index}/pieces", handleFilePieces(m))
+	for _, path := range []string{"/api/torrents/" + mt.ID, "/api/torrents/" + mt.ID + "/files/0/pieces"} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: status = %d, body %s", path, rec.Code, rec.Body)
+		}
+	}
+
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	if !mt.LastAccessed.Equal(old) {
+		t.Errorf("LastAccessed moved to %v", mt.LastAccessed)
+	}
+}
+
+func TestTorrentEventsEndOnRemoval(t *testing.T) {
+	m := newTestManager(t)
+	mt := addTestTorrent(t, m, 1<<16, testFile{path: "movie.mkv", length: 1 << 20})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/torrents/{id}/events", handleTorrentEvents(m))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(srv.URL + "/api/torrents/" + mt.ID + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+
+	var events []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		event, ok := strings.CutPrefix(scanner.Text(), "event: ")
+		if !ok {
+			continue
+		}
+		if len(events) == 0 {
+			// The handler is subscribed once the first snapshot arrives
+			if err := m.RemoveTorrent(mt.ID, false); err != nil {
+				t.Fatal(err)
+			}
+		}
+		events = append(events, event)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("stream didn't end: %v", err)
+	}
+	if len(events) < 2 || events[0] != "progress" || events[len(events)-1] != EventTorrentRemoved {
+		t.Errorf("events = %v, want a progress snapshot first and %s last", events, EventTorrentRemoved)
+	}
+}
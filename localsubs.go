@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// localIndexTTL is how long a directory listing is reused between searches.
+const localIndexTTL = time.Minute
+
+// LocalSubtitleProvider serves subtitle files from a directory tree. A file
+// named like "Movie.en.srt" is tagged with language "en".
+type LocalSubtitleProvider struct {
+	dir string
+
+	mu       sync.Mutex
+	indexed  time.Time
+	files    []localSubtitle
+	indexErr error
+}
+
+type localSubtitle struct {
+	path     string // slash separated, relative to dir
+	language string
+	words    map[string]bool // words anywhere in path
+	title    []string        // words of the file name without tags
+	media    MediaInfo
+}
+
+func NewLocalSubtitleProvider(dir string) *LocalSubtitleProvider {
+	return &LocalSubtitleProvider{dir: dir}
+}
+
+func (p *LocalSubtitleProvider) Name() string { return "local" }
+
+// Search returns the files whose path holds at least half the words of
+// query, or whose name is made only of words in query, so a release name
+// like "Movie.2019.1080p.BluRay" finds "Movie.2019.en.srt". Files tagged
+// with another language than q.Lang, or named for another season or episode,
+// are left out.
+func (p *LocalSubtitleProvider) Search(q SubtitleQuery) ([]SubSearchResult, error) {
+	files, err := p.index()
+	if err != nil {
+		return nil, err
+	}
+
+	words := searchWords(q.Text)
+	inQuery := map[string]bool{}
+	for _, w := range words {
+		inQuery[w] = true
+	}
+
+	var results []SubSearchResult
+	for _, f := range files {
+		if q.Lang != "" && f.language != "" && !sameLanguage(f.language, q.Lang) {
+			continue
+		}
+		if (q.Season != 0 && f.media.Season != 0 && f.media.Season != q.Season) ||
+			(q.Episode != 0 && f.media.Episode() != 0 && f.media.Episode() != q.Episode) {
+			continue
+		}
+		hits := 0
+		for _, w := range words {
+			if f.words[w] {
+				hits++
+			}
+		}
+		covered := len(f.title) > 0
+		for _, w := range f.title {
+			covered = covered && inQuery[w]
+		}
+		if hits*2 < len(words) && !covered {
+			continue
+		}
+		results = append(results, SubSearchResult{
+			ID:       f.path,
+			FileName: path.Base(f.path),
+			Language: f.language,
+			Release:  stripExt(path.Base(f.path)),
+		})
+	}
+	return results, nil
+}
+
+// Download reads the file with the given index-relative path.
+func (p *LocalSubtitleProvider) Download(id string) ([]byte, string, error) {
+	if !fs.ValidPath(id) || !subtitleExtensions[strings.ToLower(path.Ext(id))] {
+		return nil, "", fmt.Errorf("invalid subtitle id")
+	}
+
+	f, err := os.Open(filepath.Join(p.dir, filepath.FromSlash(id)))
+	if err != nil {
+		return nil, "", fmt.Errorf("open subtitle: %w", err)
+	}
+	defer f.Close()
+
+	content, err := io.ReadAll(io.LimitReader(f, 10<<20))
+	if err != nil {
+		return nil, "", fmt.Errorf("read subtitle: %w", err)
+	}
+	return content, path.Base(id), nil
+}
+
+// index lists the subtitle files under dir, reusing the previous listing for
+// localIndexTTL.
+func (p *LocalSubtitleProvider) index() ([]localSubtitle, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if time.Since(p.indexed) < localIndexTTL {
+		return p.files, p.indexErr
+	}
+
+	var files []localSubtitle
+	err := filepath.WalkDir(p.dir, func(full string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !subtitleExtensions[strings.ToLower(filepath.Ext(full))] {
+			return nil
+		}
+		rel, err := filepath.Rel(p.dir, full)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		words := map[string]bool{}
+		for _, w := range searchWords(rel) {
+			words[w] = true
+		}
+		name := path.Base(rel)
+		lang := subtitleLanguageTag(name)
+		title := stripExt(name)
+		if lang != "" {
+			title = stripExt(title)
+		}
+		files = append(files, localSubtitle{
+			path:     rel,
+			language: lang,
+			words:    words,
+			title:    searchWords(title),
+			media:    mediaInfoFor("", rel),
+		})
+		return nil
+	})
+
+	p.files, p.indexErr, p.indexed = files, err, time.Now()
+	if err != nil {
+		p.indexErr = fmt.Errorf("index %s: %w", p.dir, err)
+	}
+	return p.files, p.indexErr
+}
+
+// subtitleLanguageTag returns the two letter language code in names like
+// "Movie.en.srt" or "Movie.pt-BR.srt", or "" if there is none.
+func subtitleLanguageTag(name string) string {
+	tag := strings.TrimPrefix(filepath.Ext(stripExt(name)), ".")
+	code, region, _ := strings.Cut(tag, "-")
+	if len(code) != 2 || len(region) > 4 {
+		return ""
+	}
+	for _, r := range strings.ToLower(code) {
+		if r < 'a' || r > 'z' {
+			return ""
+		}
+	}
+	return tag
+}
+
+// sameLanguage compares the primary language subtags of a and b.
+func sameLanguage(a, b string) bool {
+	a, _, _ = strings.Cut(a, "-")
+	b, _, _ = strings.Cut(b, "-")
+	return strings.EqualFold(a, b)
+}
@@ -2,34 +2,50 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 	"time"
 )
 
 func main() {
-	port := flag.Int("port", 8080, "HTTP server port")
-	dataDir := flag.String("data", "/tmp/go-stream", "directory for torrent data")
-	osAPIKey := flag.String("osapi", "", "OpenSubtitles API key (or set OPENSUBTITLES_API_KEY env)")
-	flag.Parse()
-
-	// Env var fallback for API key
-	if *osAPIKey == "" {
-		*osAPIKey = os.Getenv("OPENSUBTITLES_API_KEY")
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
 	}
-	subClient := NewOpenSubClient(*osAPIKey)
 
-	manager, err := NewTorrentManager(*dataDir)
+	manager, err := NewTorrentManager(cfg.Manager)
 	if err != nil {
 		log.Fatalf("Failed to create torrent manager: %v", err)
 	}
 
+	subCache, err := NewSubtitleCache(filepath.Join(cfg.Manager.DataDir, subtitleCacheDir), cfg.SubtitleCache)
+	if err != nil {
+		log.Fatalf("Failed to create subtitle cache: %v", err)
+	}
+
+	var providers SubtitleProviders
+	if cfg.OpenSubtitlesAPIKey != "" {
+		providers = append(providers, subCache.Wrap(NewOpenSubClient(OpenSubOptions{
+			APIKey:   cfg.OpenSubtitlesAPIKey,
+			BaseURL:  cfg.OpenSubtitlesBaseURL,
+			Username: cfg.OpenSubtitlesUsername,
+			Password: cfg.OpenSubtitlesPassword,
+		})))
+	}
+	if cfg.SubtitlesDir != "" {
+		// Already on disk, so not worth caching
+		providers = append(providers, NewLocalSubtitleProvider(cfg.SubtitlesDir))
+	}
+
 	tmpl, err := template.ParseGlob("templates/*.html")
 	if err != nil {
 		log.Fatalf("Failed to parse templates: %v", err)
@@ -38,22 +54,34 @@ func main() {
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /", handleIndex(tmpl))
 	mux.HandleFunc("POST /api/magnet", handleAddMagnet(manager))
+	mux.HandleFunc("POST /api/torrent", handleAddTorrent(manager))
+	mux.HandleFunc("GET /api/torrents", handleListTorrents(manager))
+	mux.HandleFunc("GET /api/torrents/{id}", handleGetTorrent(manager))
+	mux.HandleFunc("DELETE /api/torrents/{id}", handleRemoveTorrent(manager))
+	mux.HandleFunc("GET /api/torrents/{id}/events", handleTorrentEvents(manager))
+	mux.HandleFunc("GET /api/torrents/{id}/files/{index}/pieces", handleFilePieces(manager))
 	mux.HandleFunc("POST /api/select/{torrentId}", handleSelectFile(manager))
 	mux.HandleFunc("GET /stream/{torrentId}", handleStream(manager))
+	mux.HandleFunc("GET /stream/{torrentId}/{fileIndex}", handleStream(manager))
 	mux.HandleFunc("GET /subs/{torrentId}/{fileIndex}", handleSubtitle(manager))
 	mux.HandleFunc("POST /api/subtitle/{torrentId}", handleUploadSubtitle(manager))
-	mux.HandleFunc("GET /api/subtitles/{torrentId}", handleSearchSubtitles(manager, subClient))
-	mux.HandleFunc("POST /api/subtitles/{torrentId}/download", handleDownloadSubtitle(manager, subClient))
+	mux.HandleFunc("GET /api/subtitles/{torrentId}", handleSearchSubtitles(manager, providers))
+	mux.HandleFunc("POST /api/subtitles/{torrentId}/download", handleDownloadSubtitle(manager, providers))
+	mux.HandleFunc("POST /api/subtitles/{torrentId}/{index}/shift", handleShiftSubtitle(manager))
+	mux.HandleFunc("GET /api/subtitle-cache", handleSubtitleCache(subCache))
+	mux.HandleFunc("DELETE /api/subtitle-cache", handlePurgeSubtitleCache(subCache))
 	mux.HandleFunc("POST /api/cleanup", handleCleanup(manager))
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	go manager.CleanupLoop(ctx, 24*time.Hour)
+	go manager.CleanupLoop(ctx)
 
 	srv := &http.Server{
-		Addr:    fmt.Sprintf(":%d", *port),
+		Addr:    fmt.Sprintf(":%d", cfg.Port),
 		Handler: mux,
+		// Long-lived requests such as event streams end when ctx is cancelled
+		BaseContext: func(net.Listener) context.Context { return ctx },
 	}
 
 	// Graceful shutdown
@@ -73,7 +101,7 @@ func main() {
 		}
 	}()
 
-	log.Printf("Starting server on http://localhost:%d", *port)
+	log.Printf("Starting server on http://localhost:%d", cfg.Port)
 	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
 		log.Fatalf("Server error: %v", err)
 	}
@@ -81,3 +109,78 @@ func main() {
 	manager.Close()
 	log.Println("Shutdown complete.")
 }
+
+// loadConfig builds the configuration from defaults, then the config file,
+// then environment variables, then any flags given on the command line.
+func loadConfig() (Config, error) {
+	cfg := DefaultConfig()
+
+	configPath := flag.String("config", os.Getenv("GO_STREAM_CONFIG"), "path to JSON config file (or set GO_STREAM_CONFIG env)")
+	port := flag.Int("port", cfg.Port, "HTTP server port")
+	dataDir := flag.String("data", cfg.Manager.DataDir, "directory for torrent data")
+	osAPIKey := flag.String("osapi", "", "OpenSubtitles API key (or set OPENSUBTITLES_API_KEY env)")
+	osUser := flag.String("osuser", "", "OpenSubtitles username; set the password with OPENSUBTITLES_PASSWORD")
+	osURL := flag.String("osurl", cfg.OpenSubtitlesBaseURL, "OpenSubtitles API base URL")
+	subsDir := flag.String("subs-dir", cfg.SubtitlesDir, "directory of .srt/.vtt files to offer in subtitle search")
+	maxDisk := flag.String("max-disk", "", "disk quota for torrent data, e.g. 50GB (empty for unlimited)")
+	metadataTimeout := flag.Duration("metadata-timeout", time.Duration(cfg.Manager.MetadataTimeout), "how long to wait for magnet metadata")
+	bufferTarget := flag.Duration("buffer-target", time.Duration(cfg.Manager.BufferTarget), "playback time to read ahead once a video's bitrate is known (0 for size-based readahead)")
+	cleanupInterval := flag.Duration("cleanup-interval", time.Duration(cfg.Manager.CleanupInterval), "how often to look for idle torrents")
+	cleanupMaxAge := flag.Duration("cleanup-max-age", time.Duration(cfg.Manager.CleanupMaxAge), "remove torrents idle for longer than this")
+	quotaInterval := flag.Duration("quota-interval", time.Duration(cfg.Manager.QuotaInterval), "how often to check the disk quota")
+	seed := flag.Bool("seed", cfg.Manager.Seed, "upload to peers after downloading")
+	listenPort := flag.Int("listen-port", cfg.Manager.ListenPort, "BitTorrent listen port (0 for random)")
+	flag.Parse()
+
+	if *configPath != "" {
+		if err := LoadConfigFile(*configPath, &cfg); err != nil {
+			return cfg, err
+		}
+	}
+	if err := ApplyEnv(&cfg); err != nil {
+		return cfg, err
+	}
+
+	var errs []error
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "port":
+			cfg.Port = *port
+		case "data":
+			cfg.Manager.DataDir = *dataDir
+		case "osapi":
+			cfg.OpenSubtitlesAPIKey = *osAPIKey
+		case "osuser":
+			cfg.OpenSubtitlesUsername = *osUser
+		case "osurl":
+			cfg.OpenSubtitlesBaseURL = *osURL
+		case "subs-dir":
+			cfg.SubtitlesDir = *subsDir
+		case "max-disk":
+			n, err := parseByteSize(*maxDisk)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("-max-disk: %w", err))
+			}
+			cfg.Manager.MaxDisk = ByteSize(n)
+		case "metadata-timeout":
+			cfg.Manager.MetadataTimeout = Duration(*metadataTimeout)
+		case "buffer-target":
+			cfg.Manager.BufferTarget = Duration(*bufferTarget)
+		case "cleanup-interval":
+			cfg.Manager.CleanupInterval = Duration(*cleanupInterval)
+		case "cleanup-max-age":
+			cfg.Manager.CleanupMaxAge = Duration(*cleanupMaxAge)
+		case "quota-interval":
+			cfg.Manager.QuotaInterval = Duration(*quotaInterval)
+		case "seed":
+			cfg.Manager.Seed = *seed
+		case "listen-port":
+			cfg.Manager.ListenPort = *listenPort
+		}
+	})
+	if len(errs) > 0 {
+		return cfg, errors.Join(errs...)
+	}
+
+	return cfg, cfg.Validate()
+}
@@ -0,0 +1,965 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Matroska element IDs needed to find and read text subtitle tracks and the
+// segment duration.
+const (
+	mkvEBML                = 0x1A45DFA3
+	mkvDocType             = 0x4282
+	mkvSegment             = 0x18538067
+	mkvSeekHead            = 0x114D9B74
+	mkvSeek                = 0x4DBB
+	mkvSeekID              = 0x53AB
+	mkvSeekPosition        = 0x53AC
+	mkvInfo                = 0x1549A966
+	mkvTimecodeScale       = 0x2AD7B1
+	mkvSegmentDuration     = 0x4489
+	mkvTracks              = 0x1654AE6B
+	mkvTrackEntry          = 0xAE
+	mkvTrackNumber         = 0xD7
+	mkvTrackType           = 0x83
+	mkvCodecID             = 0x86
+	mkvCodecPrivate        = 0x63A2
+	mkvLanguage            = 0x22B59C
+	mkvLanguageIETF        = 0x22B59D
+	mkvName                = 0x536E
+	mkvFlagDefault         = 0x88
+	mkvFlagForced          = 0x55AA
+	mkvDefaultDuration     = 0x23E383
+	mkvContentEncodings    = 0x6D80
+	mkvContentEncoding     = 0x6240
+	mkvContentCompression  = 0x5034
+	mkvContentCompAlgo     = 0x4254
+	mkvContentCompSettings = 0x4255
+	mkvContentEncryption   = 0x5035
+	mkvCluster             = 0x1F43B675
+	mkvTimecode            = 0xE7
+	mkvSimpleBlock         = 0xA3
+	mkvBlockGroup          = 0xA0
+	mkvBlock               = 0xA1
+	mkvBlockDuration       = 0x9B
+	mkvCues                = 0x1C53BB6B
+	mkvCuePoint            = 0xBB
+	mkvCueTime             = 0xB3
+	mkvCueTrackPositions   = 0xB7
+	mkvCueTrack            = 0xF7
+	mkvCueClusterPosition  = 0xF1
+	mkvCueRelativePosition = 0xF0
+	mkvChapters            = 0x1043A770
+	mkvTags                = 0x1254C367
+	mkvAttachments         = 0x1941A469
+)
+
+const (
+	mkvTrackTypeSubtitle = 0x11
+
+	// maxMKVElementSize bounds elements read into memory, which are metadata,
+	// cues and subtitle blocks, never video.
+	maxMKVElementSize = 64 << 20
+
+	// mkvFallbackCueDuration is used for blocks without a duration when the
+	// next cue doesn't end them sooner.
+	mkvFallbackCueDuration = 5000
+)
+
+var errMKVUnindexed = errors.New("subtitle tracks are not indexed by cues")
+
+// mkvSubtitleTrack is a text subtitle track found in a Matroska file.
+type mkvSubtitleTrack struct {
+	Number   uint64
+	Codec    string
+	Language string
+	Name     string
+	Default  bool
+	Forced   bool
+
+	private         []byte
+	defaultDuration int64 // ms, 0 when unset
+	compAlgo        int   // ContentCompAlgo, -1 when uncompressed
+	compSettings    []byte
+}
+
+// mkvSubtitle is a subtitle track converted to WebVTT.
+type mkvSubtitle struct {
+	Track mkvSubtitleTrack
+	VTT   []byte
+}
+
+// mkvFrame is a subtitle frame with its timing in milliseconds.
+type mkvFrame struct {
+	track    uint64
+	start    int64
+	duration int64 // -1 when the block has no duration
+	data     []byte
+}
+
+// mkvCueRef points at a cluster, and optionally a block inside it, holding
+// data for a track.
+type mkvCueRef struct {
+	track    uint64
+	cluster  int64 // segment relative
+	relative int64 // from the cluster's data start, -1 when unknown
+}
+
+// mkvClusterHead is where a cluster's children start and its base timecode.
+type mkvClusterHead struct {
+	dataStart int64
+	dataEnd   int64 // -1 for a cluster of unknown size
+	timecode  int64
+}
+
+type mkvReader struct {
+	r             io.ReadSeeker
+	pos           int64
+	segmentStart  int64
+	segmentEnd    int64
+	timecodeScale int64   // nanoseconds per tick
+	duration      float64 // ticks, 0 when unset
+	seeks         map[uint64]int64
+	tracks        map[uint64]*mkvSubtitleTrack
+	cues          []mkvCueRef
+	cuesRead      bool
+	firstCluster  int64
+	clusters      map[int64]mkvClusterHead
+}
+
+// extractMKVSubtitles reads every text subtitle track (SRT, ASS/SSA and
+// WebVTT) from a Matroska file and converts each to WebVTT. Only the header,
+// the cues and the clusters or blocks the cues point at are read, so on a
+// torrent reader just those pieces are fetched. Tracks the cues don't index
+// need a scan of every cluster, which only happens when scanAll is set;
+// otherwise they are left out and errMKVUnindexed is returned along with the
+// indexed tracks.
+func extractMKVSubtitles(r io.ReadSeeker, size int64, scanAll bool) ([]mkvSubtitle, error) {
+	mr, err := openMKV(r, size)
+	if err != nil {
+		return nil, err
+	}
+	if len(mr.tracks) == 0 {
+		return nil, nil
+	}
+	if err := mr.readCues(); err != nil {
+		return nil, err
+	}
+
+	blocks := map[int64]mkvFrame{} // keyed by file offset to drop duplicates
+	indexed := map[uint64]bool{}
+	scanned := map[int64]bool{}
+
+	refs := make([]mkvCueRef, 0, len(mr.cues))
+	for _, ref := range mr.cues {
+		if _, ok := mr.tracks[ref.track]; ok {
+			refs = append(refs, ref)
+			indexed[ref.track] = true
+		}
+	}
+	// Read in file order so the reader only ever moves forward
+	sort.Slice(refs, func(i, j int) bool {
+		if refs[i].cluster != refs[j].cluster {
+			return refs[i].cluster < refs[j].cluster
+		}
+		return refs[i].relative < refs[j].relative
+	})
+
+	for _, ref := range refs {
+		head, err := mr.clusterHead(ref.cluster)
+		if err != nil {
+			return nil, err
+		}
+		if ref.relative >= 0 {
+			off := head.dataStart + ref.relative
+			if _, ok := blocks[off]; ok {
+				continue
+			}
+			b, ok, err := mr.readBlockAt(off, head.timecode)
+			if err != nil {
+				return nil, err
+			}
+			if ok && b.track == ref.track {
+				blocks[off] = b
+				continue
+			}
+		}
+		if !scanned[ref.cluster] {
+			scanned[ref.cluster] = true
+			if _, err := mr.scanCluster(head, blocks); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	unindexed := len(indexed) < len(mr.tracks)
+	if unindexed && scanAll {
+		if err := mr.scanClusters(blocks); err != nil {
+			return nil, err
+		}
+	}
+
+	byTrack := map[uint64][]mkvFrame{}
+	for _, b := range blocks {
+		byTrack[b.track] = append(byTrack[b.track], b)
+	}
+
+	numbers := make([]uint64, 0, len(mr.tracks))
+	for n := range mr.tracks {
+		numbers = append(numbers, n)
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+
+	var subs []mkvSubtitle
+	for _, n := range numbers {
+		track := mr.tracks[n]
+		if !indexed[n] && !scanAll {
+			continue
+		}
+		subs = append(subs, mkvSubtitle{Track: *track, VTT: track.toVTT(byTrack[n])})
+	}
+	if unindexed && !scanAll {
+		return subs, errMKVUnindexed
+	}
+	return subs, nil
+}
+
+// mkvDuration reads the duration from a Matroska file's segment info.
+func mkvDuration(r io.ReadSeeker, size int64) (time.Duration, error) {
+	mr, err := openMKV(r, size)
+	if err != nil {
+		return 0, err
+	}
+	if mr.duration <= 0 {
+		return 0, fmt.Errorf("matroska duration not set")
+	}
+	return time.Duration(mr.duration * float64(mr.timecodeScale)), nil
+}
+
+// openMKV reads the EBML header and the segment's metadata up to the first
+// cluster, following the seek head for anything stored after it.
+func openMKV(r io.ReadSeeker, size int64) (*mkvReader, error) {
+	mr := &mkvReader{
+		r:             r,
+		timecodeScale: 1000000,
+		seeks:         map[uint64]int64{},
+		firstCluster:  -1,
+		clusters:      map[int64]mkvClusterHead{},
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	id, n, err := mr.readHeader()
+	if err != nil || id != mkvEBML || n < 0 {
+		return nil, fmt.Errorf("not a matroska file")
+	}
+	header, err := mr.readPayload(n)
+	if err != nil {
+		return nil, err
+	}
+	docType := "matroska"
+	if err := ebmlEach(header, func(id uint64, data []byte) {
+		if id == mkvDocType {
+			docType = strings.TrimRight(string(data), "\x00")
+		}
+	}); err != nil {
+		return nil, err
+	}
+	if docType != "matroska" && docType != "webm" {
+		return nil, fmt.Errorf("unsupported doctype %q", docType)
+	}
+
+	id, n, err = mr.readHeader()
+	if err != nil || id != mkvSegment {
+		return nil, fmt.Errorf("matroska segment not found")
+	}
+	mr.segmentStart = mr.pos
+	mr.segmentEnd = size
+	if n >= 0 && mr.segmentStart+n < size {
+		mr.segmentEnd = mr.segmentStart + n
+	}
+
+	read := map[int64]bool{} // segment relative positions already parsed
+	for mr.pos < mr.segmentEnd {
+		start := mr.pos
+		id, n, err := mr.readHeader()
+		if err != nil {
+			return nil, err
+		}
+		if id == mkvCluster {
+			mr.firstCluster = start
+			break
+		}
+		if n < 0 {
+			return nil, fmt.Errorf("element %#x has unknown size", id)
+		}
+		switch id {
+		case mkvSeekHead, mkvInfo, mkvTracks, mkvCues:
+			data, err := mr.readPayload(n)
+			if err != nil {
+				return nil, err
+			}
+			if err := mr.parseTopLevel(id, data); err != nil {
+				return nil, err
+			}
+			read[start-mr.segmentStart] = true
+		default:
+			if err := mr.seek(mr.pos + n); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Metadata written after the clusters, including a second seek head, is
+	// reached through the seek head
+	for _, id := range []uint64{mkvSeekHead, mkvInfo, mkvTracks} {
+		if pos, ok := mr.seeks[id]; ok && !read[pos] {
+			if err := mr.readTopLevelAt(pos, id); err != nil {
+				return nil, err
+			}
+			read[pos] = true
+		}
+	}
+	return mr, nil
+}
+
+// readCues loads the cues, which mkvmerge usually writes at the end of the
+// file, unless they were already found before the first cluster.
+func (mr *mkvReader) readCues() error {
+	if mr.cuesRead {
+		return nil
+	}
+	pos, ok := mr.seeks[mkvCues]
+	if !ok {
+		return nil
+	}
+	return mr.readTopLevelAt(pos, mkvCues)
+}
+
+func (mr *mkvReader) readTopLevelAt(pos int64, want uint64) error {
+	if err := mr.seek(mr.segmentStart + pos); err != nil {
+		return err
+	}
+	id, n, err := mr.readHeader()
+	if err != nil {
+		return err
+	}
+	if id != want || n < 0 {
+		return fmt.Errorf("seek head points at element %#x, want %#x", id, want)
+	}
+	data, err := mr.readPayload(n)
+	if err != nil {
+		return err
+	}
+	return mr.parseTopLevel(id, data)
+}
+
+func (mr *mkvReader) parseTopLevel(id uint64, data []byte) error {
+	switch id {
+	case mkvSeekHead:
+		return ebmlEach(data, func(id uint64, seek []byte) {
+			if id != mkvSeek {
+				return
+			}
+			var target uint64
+			pos := int64(-1)
+			ebmlEach(seek, func(id uint64, v []byte) {
+				switch id {
+				case mkvSeekID:
+					target = ebmlUint(v)
+				case mkvSeekPosition:
+					pos = int64(ebmlUint(v))
+				}
+			})
+			if _, dup := mr.seeks[target]; target != 0 && pos >= 0 && !dup {
+				mr.seeks[target] = pos
+			}
+		})
+	case mkvInfo:
+		return ebmlEach(data, func(id uint64, v []byte) {
+			switch id {
+			case mkvTimecodeScale:
+				if scale := int64(ebmlUint(v)); scale > 0 {
+					mr.timecodeScale = scale
+				}
+			case mkvSegmentDuration:
+				mr.duration = ebmlFloat(v)
+			}
+		})
+	case mkvTracks:
+		mr.tracks = map[uint64]*mkvSubtitleTrack{}
+		return ebmlEach(data, func(id uint64, entry []byte) {
+			if id != mkvTrackEntry {
+				return
+			}
+			if t, ok := mr.parseTrack(entry); ok {
+				mr.tracks[t.Number] = t
+			}
+		})
+	case mkvCues:
+		mr.cuesRead = true
+		return ebmlEach(data, func(id uint64, point []byte) {
+			if id != mkvCuePoint {
+				return
+			}
+			ebmlEach(point, func(id uint64, positions []byte) {
+				if id != mkvCueTrackPositions {
+					return
+				}
+				ref := mkvCueRef{cluster: -1, relative: -1}
+				ebmlEach(positions, func(id uint64, v []byte) {
+					switch id {
+					case mkvCueTrack:
+						ref.track = ebmlUint(v)
+					case mkvCueClusterPosition:
+						ref.cluster = int64(ebmlUint(v))
+					case mkvCueRelativePosition:
+						ref.relative = int64(ebmlUint(v))
+					}
+				})
+				if ref.cluster >= 0 {
+					mr.cues = append(mr.cues, ref)
+				}
+			})
+		})
+	}
+	return nil
+}
+
+// parseTrack returns the track if it is a text subtitle track we can decode.
+func (mr *mkvReader) parseTrack(entry []byte) (*mkvSubtitleTrack, bool) {
+	t := &mkvSubtitleTrack{Language: "eng", Default: true, compAlgo: -1}
+	var trackType uint64
+	var ietf string
+	encrypted := false
+
+	ebmlEach(entry, func(id uint64, v []byte) {
+		switch id {
+		case mkvTrackNumber:
+			t.Number = ebmlUint(v)
+		case mkvTrackType:
+			trackType = ebmlUint(v)
+		case mkvCodecID:
+			t.Codec = ebmlString(v)
+		case mkvCodecPrivate:
+			t.private = v
+		case mkvLanguage:
+			t.Language = ebmlString(v)
+		case mkvLanguageIETF:
+			ietf = ebmlString(v)
+		case mkvName:
+			t.Name = ebmlString(v)
+		case mkvFlagDefault:
+			t.Default = ebmlUint(v) != 0
+		case mkvFlagForced:
+			t.Forced = ebmlUint(v) != 0
+		case mkvDefaultDuration:
+			t.defaultDuration = int64(ebmlUint(v) / 1000000)
+		case mkvContentEncodings:
+			ebmlEach(v, func(id uint64, enc []byte) {
+				if id != mkvContentEncoding {
+					return
+				}
+				ebmlEach(enc, func(id uint64, v []byte) {
+					switch id {
+					case mkvContentEncryption:
+						encrypted = true
+					case mkvContentCompression:
+						t.compAlgo = 0 // zlib unless stated otherwise
+						ebmlEach(v, func(id uint64, v []byte) {
+							switch id {
+							case mkvContentCompAlgo:
+								t.compAlgo = int(ebmlUint(v))
+							case mkvContentCompSettings:
+								t.compSettings = v
+							}
+						})
+					}
+				})
+			})
+		}
+	})
+
+	if ietf != "" {
+		t.Language = ietf
+	}
+	if trackType != mkvTrackTypeSubtitle || t.Number == 0 || encrypted {
+		return nil, false
+	}
+	if t.compAlgo != -1 && t.compAlgo != 0 && t.compAlgo != 3 {
+		return nil, false
+	}
+	switch t.Codec {
+	case "S_TEXT/UTF8", "S_TEXT/ASS", "S_TEXT/SSA", "S_TEXT/WEBVTT", "D_WEBVTT/SUBTITLES":
+		return t, true
+	}
+	return nil, false
+}
+
+// clusterHead reads the header and timecode of the cluster at a segment
+// relative position.
+func (mr *mkvReader) clusterHead(pos int64) (mkvClusterHead, error) {
+	if head, ok := mr.clusters[pos]; ok {
+		return head, nil
+	}
+	if err := mr.seek(mr.segmentStart + pos); err != nil {
+		return mkvClusterHead{}, err
+	}
+	head, err := mr.readClusterHead()
+	if err != nil {
+		return head, err
+	}
+	mr.clusters[pos] = head
+	return head, nil
+}
+
+// readClusterHead reads a cluster header at the current position and the
+// children up to its timecode, which comes before any block.
+func (mr *mkvReader) readClusterHead() (mkvClusterHead, error) {
+	id, n, err := mr.readHeader()
+	if err != nil {
+		return mkvClusterHead{}, err
+	}
+	if id != mkvCluster {
+		return mkvClusterHead{}, fmt.Errorf("expected cluster, found element %#x", id)
+	}
+	head := mkvClusterHead{dataStart: mr.pos, dataEnd: -1}
+	if n >= 0 {
+		head.dataEnd = mr.pos + n
+	}
+
+	for head.dataEnd < 0 || mr.pos < head.dataEnd {
+		id, n, err := mr.readHeader()
+		if err != nil || n < 0 {
+			return head, err
+		}
+		if id == mkvSimpleBlock || id == mkvBlockGroup {
+			break
+		}
+		if id == mkvTimecode {
+			v, err := mr.readPayload(n)
+			if err != nil {
+				return head, err
+			}
+			head.timecode = int64(ebmlUint(v))
+			break
+		}
+		if err := mr.seek(mr.pos + n); err != nil {
+			return head, err
+		}
+	}
+	return head, nil
+}
+
+// readBlockAt reads the SimpleBlock or BlockGroup at a file offset. ok is
+// false when the element is not a readable subtitle block.
+func (mr *mkvReader) readBlockAt(off, clusterTimecode int64) (mkvFrame, bool, error) {
+	if err := mr.seek(off); err != nil {
+		return mkvFrame{}, false, err
+	}
+	id, n, err := mr.readHeader()
+	if err != nil {
+		return mkvFrame{}, false, err
+	}
+	if (id != mkvSimpleBlock && id != mkvBlockGroup) || n < 0 || n > maxMKVElementSize {
+		return mkvFrame{}, false, nil
+	}
+	data, err := mr.readPayload(n)
+	if err != nil {
+		return mkvFrame{}, false, err
+	}
+	b, ok := mr.parseBlock(id, data, clusterTimecode)
+	return b, ok, nil
+}
+
+// scanCluster adds every subtitle block in the cluster to blocks and returns
+// the file offset where the cluster ends.
+func (mr *mkvReader) scanCluster(head mkvClusterHead, blocks map[int64]mkvFrame) (int64, error) {
+	if err := mr.seek(head.dataStart); err != nil {
+		return 0, err
+	}
+	timecode := head.timecode
+
+	for head.dataEnd < 0 || mr.pos < head.dataEnd {
+		start := mr.pos
+		id, n, err := mr.readHeader()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return start, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		// A cluster of unknown size ends where the next top-level element starts
+		if isMKVTopLevel(id) {
+			return start, nil
+		}
+		if n < 0 {
+			return 0, fmt.Errorf("cluster child %#x has unknown size", id)
+		}
+		end := mr.pos + n
+
+		switch {
+		case id == mkvTimecode:
+			v, err := mr.readPayload(n)
+			if err != nil {
+				return 0, err
+			}
+			timecode = int64(ebmlUint(v))
+		case (id == mkvSimpleBlock || id == mkvBlockGroup) && n <= maxMKVElementSize:
+			if _, ok := blocks[start]; ok {
+				break
+			}
+			// Peek at the track number before reading a whole block
+			peek, err := mr.readPayload(min(n, 32))
+			if err != nil {
+				return 0, err
+			}
+			if track, ok := mkvBlockTrack(id, peek); ok && mr.tracks[track] == nil {
+				break
+			}
+			rest, err := mr.readPayload(n - int64(len(peek)))
+			if err != nil {
+				return 0, err
+			}
+			if b, ok := mr.parseBlock(id, append(peek, rest...), timecode); ok {
+				blocks[start] = b
+			}
+		}
+		if err := mr.seek(end); err != nil {
+			return 0, err
+		}
+	}
+	return head.dataEnd, nil
+}
+
+// scanClusters walks every cluster in the segment.
+func (mr *mkvReader) scanClusters(blocks map[int64]mkvFrame) error {
+	if mr.firstCluster < 0 {
+		return nil
+	}
+	pos := mr.firstCluster
+	for pos < mr.segmentEnd {
+		if err := mr.seek(pos); err != nil {
+			return err
+		}
+		id, n, err := mr.readHeader()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if id != mkvCluster {
+			if n < 0 {
+				return nil
+			}
+			pos = mr.pos + n
+			continue
+		}
+
+		if err := mr.seek(pos); err != nil {
+			return err
+		}
+		head, err := mr.readClusterHead()
+		if err != nil {
+			return err
+		}
+		if pos, err = mr.scanCluster(head, blocks); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseBlock decodes a SimpleBlock or BlockGroup payload for one of the
+// subtitle tracks.
+func (mr *mkvReader) parseBlock(id uint64, data []byte, clusterTimecode int64) (mkvFrame, bool) {
+	duration := int64(-1)
+	if id == mkvBlockGroup {
+		var block []byte
+		ebmlEach(data, func(id uint64, v []byte) {
+			switch id {
+			case mkvBlock:
+				block = v
+			case mkvBlockDuration:
+				duration = mr.millis(int64(ebmlUint(v)))
+			}
+		})
+		data = block
+	}
+
+	track, n, ok := ebmlVint(data)
+	if !ok || len(data) < n+3 {
+		return mkvFrame{}, false
+	}
+	t := mr.tracks[track]
+	if t == nil {
+		return mkvFrame{}, false
+	}
+	relative := int64(int16(uint16(data[n])<<8 | uint16(data[n+1])))
+	if lacing := data[n+2] >> 1 & 3; lacing != 0 {
+		return mkvFrame{}, false // subtitle frames are never laced
+	}
+	payload, err := t.decode(data[n+3:])
+	if err != nil {
+		return mkvFrame{}, false
+	}
+	if duration < 0 && t.defaultDuration > 0 {
+		duration = t.defaultDuration
+	}
+	return mkvFrame{
+		track:    track,
+		start:    max(mr.millis(clusterTimecode+relative), 0),
+		duration: duration,
+		data:     payload,
+	}, true
+}
+
+func (mr *mkvReader) millis(ticks int64) int64 {
+	return ticks * mr.timecodeScale / 1000000
+}
+
+// decode undoes the track's content compression.
+func (t *mkvSubtitleTrack) decode(data []byte) ([]byte, error) {
+	switch t.compAlgo {
+	case 0:
+		zr, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		return io.ReadAll(io.LimitReader(zr, maxMKVElementSize))
+	case 3:
+		return append(append([]byte(nil), t.compSettings...), data...), nil
+	}
+	return data, nil
+}
+
+// toVTT converts the track's blocks to a WebVTT document.
+func (t *mkvSubtitleTrack) toVTT(blocks []mkvFrame) []byte {
+	sort.SliceStable(blocks, func(i, j int) bool { return blocks[i].start < blocks[j].start })
+
+	ends := make([]int64, len(blocks))
+	for i, b := range blocks {
+		switch {
+		case b.duration >= 0:
+			ends[i] = b.start + b.duration
+		case i+1 < len(blocks):
+			ends[i] = min(blocks[i+1].start, b.start+mkvFallbackCueDuration)
+		default:
+			ends[i] = b.start + mkvFallbackCueDuration
+		}
+	}
+
+	if t.Codec == "S_TEXT/ASS" || t.Codec == "S_TEXT/SSA" {
+		return ConvertASStoVTT(t.assDocument(blocks, ends))
+	}
+
+	track := &Track{}
+	for i, b := range blocks {
+		text := strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(string(b.data))
+		track.Cues = append(track.Cues, Cue{Start: int(b.start), End: int(ends[i]), Text: strings.TrimSpace(text)})
+	}
+	return track.VTT()
+}
+
+// assDocument rebuilds an ASS script from the track header in CodecPrivate
+// and the blocks, which hold Dialogue fields without timing:
+// ReadOrder, Layer, Style, Name, MarginL, MarginR, MarginV, Effect, Text.
+func (t *mkvSubtitleTrack) assDocument(blocks []mkvFrame, ends []int64) []byte {
+	var buf bytes.Buffer
+	buf.Write(t.private)
+	if !bytes.Contains(bytes.ToLower(t.private), []byte("[events]")) {
+		buf.WriteString("\n[Events]\n")
+		if t.Codec == "S_TEXT/SSA" {
+			buf.WriteString("Format: Marked, Start, End, Style, Name, MarginL, MarginR, MarginV, Effect, Text\n")
+		} else {
+			buf.WriteString("Format: Layer, Start, End, Style, Name, MarginL, MarginR, MarginV, Effect, Text\n")
+		}
+	}
+	buf.WriteByte('\n')
+
+	for i, b := range blocks {
+		fields := strings.SplitN(string(b.data), ",", 3)
+		if len(fields) < 3 {
+			continue
+		}
+		fmt.Fprintf(&buf, "Dialogue: %s,%s,%s,%s\n", fields[1], formatASSTime(b.start), formatASSTime(ends[i]), fields[2])
+	}
+	return buf.Bytes()
+}
+
+// formatASSTime formats milliseconds as H:MM:SS.cc.
+func formatASSTime(ms int64) string {
+	cs := ms / 10
+	return fmt.Sprintf("%d:%02d:%02d.%02d", cs/360000, cs/6000%60, cs/100%60, cs%100)
+}
+
+func (mr *mkvReader) seek(off int64) error {
+	if off == mr.pos {
+		return nil
+	}
+	if _, err := mr.r.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+	mr.pos = off
+	return nil
+}
+
+// readHeader reads an element ID and data size. size is -1 when unknown.
+func (mr *mkvReader) readHeader() (id uint64, size int64, err error) {
+	var buf [8]byte
+	if _, err := io.ReadFull(mr.r, buf[:1]); err != nil {
+		return 0, 0, err
+	}
+	idLen := bits.LeadingZeros8(buf[0]) + 1
+	if idLen > 4 {
+		return 0, 0, fmt.Errorf("invalid element id at offset %d", mr.pos)
+	}
+	if _, err := io.ReadFull(mr.r, buf[1:idLen]); err != nil {
+		return 0, 0, err
+	}
+	for _, b := range buf[:idLen] {
+		id = id<<8 | uint64(b)
+	}
+
+	if _, err := io.ReadFull(mr.r, buf[:1]); err != nil {
+		return 0, 0, err
+	}
+	sizeLen := bits.LeadingZeros8(buf[0]) + 1
+	if sizeLen > 8 {
+		return 0, 0, fmt.Errorf("invalid element size at offset %d", mr.pos)
+	}
+	if _, err := io.ReadFull(mr.r, buf[1:sizeLen]); err != nil {
+		return 0, 0, err
+	}
+	v, _, _ := ebmlVint(buf[:sizeLen])
+	mr.pos += int64(idLen + sizeLen)
+
+	if v == 1<<(7*sizeLen)-1 {
+		return id, -1, nil
+	}
+	if v > 1<<62 {
+		return 0, 0, fmt.Errorf("element size too large at offset %d", mr.pos)
+	}
+	return id, int64(v), nil
+}
+
+func (mr *mkvReader) readPayload(n int64) ([]byte, error) {
+	if n > maxMKVElementSize {
+		return nil, fmt.Errorf("element of %d bytes is too large", n)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(mr.r, buf); err != nil {
+		return nil, err
+	}
+	mr.pos += n
+	return buf, nil
+}
+
+func isMKVTopLevel(id uint64) bool {
+	switch id {
+	case mkvCluster, mkvCues, mkvSeekHead, mkvInfo, mkvTracks, mkvChapters, mkvTags, mkvAttachments:
+		return true
+	}
+	return false
+}
+
+// mkvBlockTrack reads the track number from the start of a SimpleBlock or
+// BlockGroup payload.
+func mkvBlockTrack(id uint64, data []byte) (uint64, bool) {
+	if id == mkvBlockGroup {
+		child, payload, _, ok := ebmlNext(data)
+		if !ok || child != mkvBlock {
+			return 0, false
+		}
+		data = payload
+	}
+	track, _, ok := ebmlVint(data)
+	return track, ok
+}
+
+// ebmlVint decodes a variable length integer with its length marker removed.
+func ebmlVint(b []byte) (v uint64, n int, ok bool) {
+	if len(b) == 0 || b[0] == 0 {
+		return 0, 0, false
+	}
+	n = bits.LeadingZeros8(b[0]) + 1
+	if len(b) < n {
+		return 0, 0, false
+	}
+	v = uint64(b[0] & (0xFF >> n))
+	for _, c := range b[1:n] {
+		v = v<<8 | uint64(c)
+	}
+	return v, n, true
+}
+
+// ebmlNext splits the first element off data. A truncated payload, as when
+// peeking, is returned as far as it goes.
+func ebmlNext(data []byte) (id uint64, payload, rest []byte, ok bool) {
+	if len(data) == 0 {
+		return 0, nil, nil, false
+	}
+	idLen := bits.LeadingZeros8(data[0]) + 1
+	if idLen > 4 || len(data) < idLen {
+		return 0, nil, nil, false
+	}
+	for _, b := range data[:idLen] {
+		id = id<<8 | uint64(b)
+	}
+	size, sizeLen, ok := ebmlVint(data[idLen:])
+	if !ok {
+		return 0, nil, nil, false
+	}
+	data = data[idLen+sizeLen:]
+	if size == 1<<(7*sizeLen)-1 || size > uint64(len(data)) {
+		return id, data, nil, true
+	}
+	return id, data[:size], data[size:], true
+}
+
+// ebmlEach calls fn for each child element in data.
+func ebmlEach(data []byte, fn func(id uint64, payload []byte)) error {
+	for len(data) > 0 {
+		id, payload, rest, ok := ebmlNext(data)
+		if !ok {
+			return fmt.Errorf("malformed matroska element")
+		}
+		fn(id, payload)
+		data = rest
+	}
+	return nil
+}
+
+func ebmlUint(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+func ebmlFloat(b []byte) float64 {
+	switch len(b) {
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b)))
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func ebmlString(b []byte) string {
+	return strings.TrimRight(string(b), "\x00")
+}
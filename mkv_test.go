@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/bits"
+	"testing"
+)
+
+// ebmlElem encodes an element with an 8 byte size so offsets are easy to
+// predict when building test files.
+func ebmlElem(id uint64, children ...[]byte) []byte {
+	var payload []byte
+	for _, c := range children {
+		payload = append(payload, c...)
+	}
+	idBytes := binary.BigEndian.AppendUint64(nil, id)[bits.LeadingZeros64(id)/8:]
+	size := binary.BigEndian.AppendUint64(nil, uint64(len(payload)))
+	size[0] = 0x01
+	return append(append(idBytes, size...), payload...)
+}
+
+func ebmlUintElem(id, v uint64) []byte {
+	return ebmlElem(id, binary.BigEndian.AppendUint64(nil, v))
+}
+
+func mkvTestBlock(track uint64, relative int16, data string) []byte {
+	return append([]byte{0x80 | byte(track), byte(uint16(relative) >> 8), byte(relative), 0x80}, data...)
+}
+
+// readLog records which byte ranges were read through it.
+type readLog struct {
+	io.ReadSeeker
+	pos    int64
+	ranges [][2]int64
+}
+
+func (r *readLog) Read(p []byte) (int, error) {
+	n, err := r.ReadSeeker.Read(p)
+	r.ranges = append(r.ranges, [2]int64{r.pos, r.pos + int64(n)})
+	r.pos += int64(n)
+	return n, err
+}
+
+func (r *readLog) Seek(off int64, whence int) (int64, error) {
+	pos, err := r.ReadSeeker.Seek(off, whence)
+	r.pos = pos
+	return pos, err
+}
+
+func (r *readLog) touched(start, end int64) bool {
+	for _, rg := range r.ranges {
+		if rg[0] < end && start < rg[1] {
+			return true
+		}
+	}
+	return false
+}
+
+type mkvTestFile struct {
+	data       []byte
+	videoStart int64 // file offsets of video data past what a peek reads
+	videoEnd   int64
+}
+
+// buildTestMKV writes a file with a video track, an SRT style track, an ASS
+// track and a PGS track that must be ignored. cues controls whether the
+// subtitle blocks are indexed, all of them or only the SRT style track's,
+// and with relative positions or not.
+func buildTestMKV(cues string) mkvTestFile {
+	const assHeader = "[Script Info]\nScriptType: v4.00+\n\n[V4+ Styles]\n" +
+		"Format: Name, Fontname, Fontsize, PrimaryColour, Bold, Italic, Underline, Alignment\n" +
+		"Style: Default,Arial,20,&H00FFFFFF,0,0,0,2\n\n[Events]\n" +
+		"Format: Layer, Start, End, Style, Name, MarginL, MarginR, MarginV, Effect, Text\n"
+
+	video := bytes.Repeat([]byte{0xAB}, 64<<10)
+
+	info := ebmlElem(mkvInfo, ebmlUintElem(mkvTimecodeScale, 1000000))
+	tracks := ebmlElem(mkvTracks,
+		ebmlElem(mkvTrackEntry, ebmlUintElem(mkvTrackNumber, 1), ebmlUintElem(mkvTrackType, 1), ebmlElem(mkvCodecID, []byte("V_MPEG4/ISO/AVC"))),
+		ebmlElem(mkvTrackEntry, ebmlUintElem(mkvTrackNumber, 2), ebmlUintElem(mkvTrackType, 0x11), ebmlElem(mkvCodecID, []byte("S_TEXT/UTF8")),
+			ebmlElem(mkvLanguage, []byte("ger")), ebmlElem(mkvName, []byte("Forced")), ebmlUintElem(mkvFlagForced, 1)),
+		ebmlElem(mkvTrackEntry, ebmlUintElem(mkvTrackNumber, 3), ebmlUintElem(mkvTrackType, 0x11), ebmlElem(mkvCodecID, []byte("S_TEXT/ASS")),
+			ebmlElem(mkvCodecPrivate, []byte(assHeader)), ebmlElem(mkvLanguageIETF, []byte("en-US"))),
+		ebmlElem(mkvTrackEntry, ebmlUintElem(mkvTrackNumber, 4), ebmlUintElem(mkvTrackType, 0x11), ebmlElem(mkvCodecID, []byte("S_HDMV/PGS"))),
+	)
+
+	videoFrame := ebmlElem(mkvSimpleBlock, mkvTestBlock(1, 0, string(video)))
+	sub1 := ebmlElem(mkvBlockGroup, ebmlElem(mkvBlock, mkvTestBlock(2, 1000, "Hallo")), ebmlUintElem(mkvBlockDuration, 1500))
+	sub2 := ebmlElem(mkvBlockGroup, ebmlElem(mkvBlock, mkvTestBlock(3, 2000, `0,0,Default,,0,0,0,,{\i1}Hi{\i0} there`)), ebmlUintElem(mkvBlockDuration, 1000))
+	sub3 := ebmlElem(mkvSimpleBlock, mkvTestBlock(2, 0, "Second\r\nline"))
+	pgs := ebmlElem(mkvSimpleBlock, mkvTestBlock(4, 100, "\x16\x00"))
+
+	timecode0 := ebmlUintElem(mkvTimecode, 0)
+	cluster1 := ebmlElem(mkvCluster, timecode0, videoFrame, sub1, sub2, pgs)
+	cluster2 := ebmlElem(mkvCluster, ebmlUintElem(mkvTimecode, 5000), sub3, videoFrame)
+
+	// The seek head has a fixed size, so later offsets don't depend on it
+	seekHeadLen := len(ebmlElem(mkvSeekHead, ebmlElem(mkvSeek, ebmlElem(mkvSeekID, []byte{0x1C, 0x53, 0xBB, 0x6B}), ebmlUintElem(mkvSeekPosition, 0))))
+	c1 := int64(seekHeadLen + len(info) + len(tracks))
+	c2 := c1 + int64(len(cluster1))
+	cuesPos := c2 + int64(len(cluster2))
+	seekHead := ebmlElem(mkvSeekHead, ebmlElem(mkvSeek, ebmlElem(mkvSeekID, []byte{0x1C, 0x53, 0xBB, 0x6B}), ebmlUintElem(mkvSeekPosition, uint64(cuesPos))))
+
+	// Relative positions count from the end of the cluster header
+	rel1 := uint64(len(timecode0) + len(videoFrame))
+	rel2 := rel1 + uint64(len(sub1))
+	cuePoint := func(time, track uint64, cluster int64, rel uint64) []byte {
+		positions := [][]byte{ebmlUintElem(mkvCueTrack, track), ebmlUintElem(mkvCueClusterPosition, uint64(cluster))}
+		if cues == "relative" {
+			positions = append(positions, ebmlUintElem(mkvCueRelativePosition, rel))
+		}
+		return ebmlElem(mkvCuePoint, ebmlUintElem(mkvCueTime, time), ebmlElem(mkvCueTrackPositions, positions...))
+	}
+	var cuesElem []byte
+	switch cues {
+	case "partly":
+		// The ASS track has no cues
+		cuesElem = ebmlElem(mkvCues,
+			cuePoint(0, 1, c1, 0),
+			cuePoint(1000, 2, c1, 0),
+			cuePoint(5000, 2, c2, 0),
+		)
+	case "relative", "cluster":
+		cuesElem = ebmlElem(mkvCues,
+			cuePoint(0, 1, c1, 0),
+			cuePoint(1000, 2, c1, rel1),
+			cuePoint(2000, 3, c1, rel2),
+			cuePoint(5000, 2, c2, uint64(len(ebmlUintElem(mkvTimecode, 5000)))),
+		)
+	default:
+		cuesElem = ebmlElem(mkvCues, cuePoint(0, 1, c1, 0))
+	}
+
+	header := ebmlElem(mkvEBML, ebmlElem(mkvDocType, []byte("matroska")))
+	segment := ebmlElem(mkvSegment, seekHead, info, tracks, cluster1, cluster2, cuesElem)
+	data := append(header, segment...)
+
+	// Cluster scans peek at the first 32 bytes of each block for its track
+	payload := int64(len(header)+12) + c1 + 12 + int64(len(timecode0)) + 12
+	return mkvTestFile{
+		data:       data,
+		videoStart: payload + 32,
+		videoEnd:   payload + int64(len(videoFrame)) - 12,
+	}
+}
+
+func TestExtractMKVSubtitles(t *testing.T) {
+	const (
+		wantUTF8 = "WEBVTT\n\n00:00:01.000 --> 00:00:02.500\nHallo\n\n00:00:05.000 --> 00:00:10.000\nSecond\nline\n"
+		wantASS  = "WEBVTT\n\n00:00:02.000 --> 00:00:03.000\n<i>Hi</i> there\n"
+	)
+
+	tests := []struct {
+		name      string
+		cues      string
+		scanAll   bool
+		wantErr   error
+		skipVideo bool // the video data must not be read
+	}{
+		{name: "cues with relative positions", cues: "relative", skipVideo: true},
+		{name: "cues with cluster positions", cues: "cluster", skipVideo: true},
+		{name: "unindexed on partial file", cues: "none", wantErr: errMKVUnindexed},
+		{name: "unindexed on complete file", cues: "none", scanAll: true, skipVideo: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := buildTestMKV(tt.cues)
+			r := &readLog{ReadSeeker: bytes.NewReader(f.data)}
+
+			subs, err := extractMKVSubtitles(r, int64(len(f.data)), tt.scanAll)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("extractMKVSubtitles() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			if tt.skipVideo && r.touched(f.videoStart, f.videoEnd) {
+				t.Errorf("video frame data was read")
+			}
+
+			if len(subs) != 2 {
+				t.Fatalf("got %d subtitle tracks, want 2", len(subs))
+			}
+			if got := subs[0].Track; got.Number != 2 || got.Language != "ger" || got.Name != "Forced" || !got.Forced {
+				t.Errorf("track 2 = %+v", got)
+			}
+			if got := subs[1].Track; got.Number != 3 || got.Language != "en-US" {
+				t.Errorf("track 3 = %+v", got)
+			}
+			if got := string(subs[0].VTT); got != wantUTF8 {
+				t.Errorf("UTF8 track:\ngot:\n%q\nwant:\n%q", got, wantUTF8)
+			}
+			if got := string(subs[1].VTT); got != wantASS {
+				t.Errorf("ASS track:\ngot:\n%q\nwant:\n%q", got, wantASS)
+			}
+		})
+	}
+}
+
+func TestExtractMKVSubtitlesPartlyIndexed(t *testing.T) {
+	f := buildTestMKV("partly")
+	subs, err := extractMKVSubtitles(bytes.NewReader(f.data), int64(len(f.data)), false)
+	if !errors.Is(err, errMKVUnindexed) {
+		t.Fatalf("extractMKVSubtitles() error = %v, want %v", err, errMKVUnindexed)
+	}
+	if len(subs) != 1 || subs[0].Track.Number != 2 {
+		t.Fatalf("got %+v, want only the indexed track 2", subs)
+	}
+
+	subs, err = extractMKVSubtitles(bytes.NewReader(f.data), int64(len(f.data)), true)
+	if err != nil || len(subs) != 2 {
+		t.Fatalf("with scanAll got %d tracks, error %v; want 2 tracks", len(subs), err)
+	}
+}
+
+func TestExtractMKVSubtitlesNotMatroska(t *testing.T) {
+	data := []byte("not a video file at all")
+	if _, err := extractMKVSubtitles(bytes.NewReader(data), int64(len(data)), true); err == nil {
+		t.Fatal("expected an error for non-matroska input")
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// mp4Duration reads the duration from an MP4/MOV file's movie header. Only
+// the box headers on the way to moov/mvhd are read, so the media data is
+// skipped wherever the moov box sits.
+func mp4Duration(r io.ReadSeeker, size int64) (time.Duration, error) {
+	moovStart, moovEnd, err := mp4FindBox(r, 0, size, "moov")
+	if err != nil {
+		return 0, err
+	}
+	mvhdStart, mvhdEnd, err := mp4FindBox(r, moovStart, moovEnd, "mvhd")
+	if err != nil {
+		return 0, err
+	}
+	if _, err := r.Seek(mvhdStart, io.SeekStart); err != nil {
+		return 0, err
+	}
+	mvhd := make([]byte, min(mvhdEnd-mvhdStart, 32))
+	if _, err := io.ReadFull(r, mvhd); err != nil {
+		return 0, fmt.Errorf("read mvhd: %w", err)
+	}
+
+	var timescale, duration uint64
+	switch {
+	case len(mvhd) >= 20 && mvhd[0] == 0:
+		timescale = uint64(binary.BigEndian.Uint32(mvhd[12:]))
+		duration = uint64(binary.BigEndian.Uint32(mvhd[16:]))
+	case len(mvhd) >= 32 && mvhd[0] == 1:
+		timescale = uint64(binary.BigEndian.Uint32(mvhd[20:]))
+		duration = binary.BigEndian.Uint64(mvhd[24:])
+	default:
+		return 0, fmt.Errorf("unsupported mvhd")
+	}
+	// A duration of all ones means unknown
+	if timescale == 0 || duration == 0 || duration == 1<<32-1 || duration == 1<<64-1 {
+		return 0, fmt.Errorf("mp4 duration not set")
+	}
+	return time.Duration(float64(duration) / float64(timescale) * float64(time.Second)), nil
+}
+
+// mp4FindBox returns the payload span of the first box of type typ between
+// start and end.
+func mp4FindBox(r io.ReadSeeker, start, end int64, typ string) (int64, int64, error) {
+	var header [16]byte
+	for pos := start; pos+8 <= end; {
+		if _, err := r.Seek(pos, io.SeekStart); err != nil {
+			return 0, 0, err
+		}
+		if _, err := io.ReadFull(r, header[:8]); err != nil {
+			return 0, 0, fmt.Errorf("read box header: %w", err)
+		}
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		payload := pos + 8
+		switch size {
+		case 0: // extends to the end
+			size = end - pos
+		case 1: // 64-bit size follows the type
+			if _, err := io.ReadFull(r, header[8:]); err != nil {
+				return 0, 0, fmt.Errorf("read box header: %w", err)
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:]))
+			payload += 8
+		}
+		if size < payload-pos || pos+size > end {
+			return 0, 0, fmt.Errorf("invalid %q box size %d", header[4:8], size)
+		}
+		if string(header[4:8]) == typ {
+			return payload, pos + size, nil
+		}
+		pos += size
+	}
+	return 0, 0, fmt.Errorf("%s box not found", typ)
+}
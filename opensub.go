@@ -1,50 +1,109 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 const openSubBaseURL = "https://api.opensubtitles.com/api/v1"
 
+// errSubtitleQuota is returned by Download once the daily download quota is
+// used up.
+var errSubtitleQuota = errors.New("subtitle download quota exhausted")
+
 type OpenSubClient struct {
 	apiKey     string
+	username   string
+	password   string
+	baseURL    string
 	httpClient *http.Client
+
+	mu     sync.Mutex
+	token  string // JWT from login, empty until the first download
+	apiURL string // baseURL moved to the host login returned
+	quota  *SubtitleQuota
+}
+
+// OpenSubOptions configures an OpenSubClient. Username and Password are
+// optional; when set, downloads count against that account's quota rather
+// than the much smaller anonymous one.
+type OpenSubOptions struct {
+	APIKey   string
+	BaseURL  string // defaults to openSubBaseURL
+	Username string
+	Password string
+}
+
+// SubtitleQuota is what is left of a provider's download allowance.
+type SubtitleQuota struct {
+	Remaining int        `json:"remaining"`
+	ResetTime string     `json:"resetTime,omitempty"` // e.g. "23 hours and 57 minutes"
+	ResetAt   *time.Time `json:"resetAt,omitempty"`
 }
 
 type SubSearchResult struct {
-	FileID   int    `json:"fileId"`
-	FileName string `json:"fileName"`
-	Language string `json:"language"`
-	Release  string `json:"release"`
-	Rating   float64 `json:"rating"`
-	Downloads int    `json:"downloads"`
+	Provider  string  `json:"provider"`
+	ID        string  `json:"id"` // passed back to the provider's Download
+	Score     float64 `json:"score"`
+	FileID    int     `json:"fileId,omitempty"` // OpenSubtitles only
+	FileName  string  `json:"fileName"`
+	Language  string  `json:"language"`
+	Release   string  `json:"release"`
+	Rating    float64 `json:"rating"`
+	Downloads int     `json:"downloads"`
+	HashMatch bool    `json:"hashMatch,omitempty"` // made for this exact video file
 }
 
-func NewOpenSubClient(apiKey string) *OpenSubClient {
+func NewOpenSubClient(opts OpenSubOptions) *OpenSubClient {
+	baseURL := strings.TrimRight(opts.BaseURL, "/")
+	if baseURL == "" {
+		baseURL = openSubBaseURL
+	}
 	return &OpenSubClient{
-		apiKey: apiKey,
+		apiKey:     opts.APIKey,
+		username:   opts.Username,
+		password:   opts.Password,
+		baseURL:    baseURL,
 		httpClient: &http.Client{Timeout: 15 * time.Second},
 	}
 }
 
-func (c *OpenSubClient) Search(query, lang string) ([]SubSearchResult, error) {
+func (c *OpenSubClient) Name() string { return "opensubtitles" }
+
+func (c *OpenSubClient) Search(q SubtitleQuery) ([]SubSearchResult, error) {
 	if c.apiKey == "" {
 		return nil, fmt.Errorf("OpenSubtitles API key not configured")
 	}
 
 	params := url.Values{}
-	params.Set("query", query)
-	if lang != "" {
-		params.Set("languages", lang)
+	params.Set("query", q.Text)
+	if q.Lang != "" {
+		params.Set("languages", q.Lang)
+	}
+	if q.MovieHash != "" {
+		params.Set("moviehash", q.MovieHash)
+	}
+	if q.Year != 0 {
+		params.Set("year", strconv.Itoa(q.Year))
+	}
+	if q.Season != 0 {
+		params.Set("season_number", strconv.Itoa(q.Season))
+	}
+	if q.Episode != 0 {
+		params.Set("episode_number", strconv.Itoa(q.Episode))
 	}
 
-	req, err := http.NewRequest("GET", openSubBaseURL+"/subtitles?"+params.Encode(), nil)
+	req, err := http.NewRequest("GET", c.apiBase()+"/subtitles?"+params.Encode(), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -65,11 +124,12 @@ func (c *OpenSubClient) Search(query, lang string) ([]SubSearchResult, error) {
 	var apiResp struct {
 		Data []struct {
 			Attributes struct {
-				Language     string  `json:"language"`
-				Release      string  `json:"release"`
-				Rating       float64 `json:"ratings"`
-				DownloadCount int    `json:"download_count"`
-				Files        []struct {
+				Language       string  `json:"language"`
+				Release        string  `json:"release"`
+				Rating         float64 `json:"ratings"`
+				DownloadCount  int     `json:"download_count"`
+				MovieHashMatch bool    `json:"moviehash_match"`
+				Files          []struct {
 					FileID   int    `json:"file_id"`
 					FileName string `json:"file_name"`
 				} `json:"files"`
@@ -85,12 +145,14 @@ func (c *OpenSubClient) Search(query, lang string) ([]SubSearchResult, error) {
 	for _, d := range apiResp.Data {
 		for _, f := range d.Attributes.Files {
 			results = append(results, SubSearchResult{
+				ID:        strconv.Itoa(f.FileID),
 				FileID:    f.FileID,
 				FileName:  f.FileName,
 				Language:  d.Attributes.Language,
 				Release:   d.Attributes.Release,
 				Rating:    d.Attributes.Rating,
 				Downloads: d.Attributes.DownloadCount,
+				HashMatch: d.Attributes.MovieHashMatch,
 			})
 		}
 	}
@@ -98,39 +160,66 @@ func (c *OpenSubClient) Search(query, lang string) ([]SubSearchResult, error) {
 	return results, nil
 }
 
-func (c *OpenSubClient) Download(fileID int) ([]byte, string, error) {
+// Download fetches the subtitle file whose numeric file ID is id. With a
+// username configured it logs in first, and again if the token is rejected.
+func (c *OpenSubClient) Download(id string) ([]byte, string, error) {
 	if c.apiKey == "" {
 		return nil, "", fmt.Errorf("OpenSubtitles API key not configured")
 	}
+	fileID, err := strconv.Atoi(id)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid OpenSubtitles file ID %q", id)
+	}
 
-	body := fmt.Sprintf(`{"file_id":%d}`, fileID)
-	req, err := http.NewRequest("POST", openSubBaseURL+"/download", strings.NewReader(body))
+	token, err := c.authToken(false)
 	if err != nil {
 		return nil, "", err
 	}
-	req.Header.Set("Api-Key", c.apiKey)
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("User-Agent", "go-torrent-stream v1.0")
-
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.requestDownload(fileID, token)
 	if err != nil {
-		return nil, "", fmt.Errorf("download request failed: %w", err)
+		return nil, "", err
+	}
+	if resp.StatusCode == http.StatusUnauthorized && c.username != "" {
+		resp.Body.Close()
+		if token, err = c.authToken(true); err != nil {
+			return nil, "", err
+		}
+		if resp, err = c.requestDownload(fileID, token); err != nil {
+			return nil, "", err
+		}
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
+	// 406 is how the API reports a used up quota, with the same fields
+	if resp.StatusCode != 200 && resp.StatusCode != http.StatusNotAcceptable {
 		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
 		return nil, "", fmt.Errorf("download API error %d: %s", resp.StatusCode, string(respBody))
 	}
 
 	var dlResp struct {
-		Link     string `json:"link"`
-		FileName string `json:"file_name"`
+		Link         string `json:"link"`
+		FileName     string `json:"file_name"`
+		Remaining    int    `json:"remaining"`
+		Message      string `json:"message"`
+		ResetTime    string `json:"reset_time"`
+		ResetTimeUTC string `json:"reset_time_utc"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&dlResp); err != nil {
 		return nil, "", fmt.Errorf("decode download response: %w", err)
 	}
 
+	quota := &SubtitleQuota{Remaining: dlResp.Remaining, ResetTime: dlResp.ResetTime}
+	if t, err := time.Parse(time.RFC3339, dlResp.ResetTimeUTC); err == nil {
+		quota.ResetAt = &t
+	}
+	c.mu.Lock()
+	c.quota = quota
+	c.mu.Unlock()
+
+	if resp.StatusCode == http.StatusNotAcceptable {
+		return nil, "", fmt.Errorf("%w: %s", errSubtitleQuota, dlResp.Message)
+	}
+
 	// Fetch the actual subtitle file
 	fileResp, err := c.httpClient.Get(dlResp.Link)
 	if err != nil {
@@ -145,3 +234,137 @@ func (c *OpenSubClient) Download(fileID int) ([]byte, string, error) {
 
 	return content, dlResp.FileName, nil
 }
+
+// Quota returns the download quota reported by the last download, if any.
+func (c *OpenSubClient) Quota() (SubtitleQuota, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.quota == nil {
+		return SubtitleQuota{}, false
+	}
+	return *c.quota, true
+}
+
+func (c *OpenSubClient) requestDownload(fileID int, token string) (*http.Response, error) {
+	body := fmt.Sprintf(`{"file_id":%d}`, fileID)
+	req, err := http.NewRequest("POST", c.apiBase()+"/download", strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Api-Key", c.apiKey)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "go-torrent-stream v1.0")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("download request failed: %w", err)
+	}
+	return resp, nil
+}
+
+// authToken returns the cached login token, logging in if there is none or
+// refresh is set. It returns "" when no username is configured.
+func (c *OpenSubClient) authToken(refresh bool) (string, error) {
+	if c.username == "" {
+		return "", nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && !refresh {
+		return c.token, nil
+	}
+
+	body, err := json.Marshal(map[string]string{"username": c.username, "password": c.password})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("POST", c.baseURL+"/login", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Api-Key", c.apiKey)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "go-torrent-stream v1.0")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("login request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("OpenSubtitles login error %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	var loginResp struct {
+		Token   string `json:"token"`
+		BaseURL string `json:"base_url"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&loginResp); err != nil {
+		return "", fmt.Errorf("decode login response: %w", err)
+	}
+	if loginResp.Token == "" {
+		return "", fmt.Errorf("OpenSubtitles login returned no token")
+	}
+
+	c.token = loginResp.Token
+	c.apiURL = withHost(c.baseURL, loginResp.BaseURL)
+	return c.token, nil
+}
+
+// apiBase is the URL API calls go to: the configured base URL, or the host
+// assigned at login once logged in.
+func (c *OpenSubClient) apiBase() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.apiURL != "" {
+		return c.apiURL
+	}
+	return c.baseURL
+}
+
+// withHost replaces the host of base with host, which may be a bare host
+// name as login returns it ("vip-api.opensubtitles.com") or a full URL.
+func withHost(base, host string) string {
+	u, err := url.Parse(base)
+	if err != nil || host == "" {
+		return base
+	}
+	if h, err := url.Parse(host); err == nil && h.Host != "" {
+		host = h.Host
+	}
+	u.Host = host
+	return u.String()
+}
+
+// openSubHashChunk is how much of each end of a file the hash covers.
+const openSubHashChunk = 64 << 10
+
+// openSubHash computes the OpenSubtitles movie hash: the file size plus the
+// sum of the file's first and last 64 KiB read as little-endian uint64s,
+// as 16 hex digits. Only those two ranges are read from r.
+func openSubHash(r io.ReadSeeker, size int64) (string, error) {
+	if size < openSubHashChunk {
+		return "", fmt.Errorf("file too small to hash")
+	}
+
+	hash := uint64(size)
+	buf := make([]byte, openSubHashChunk)
+	for _, off := range []int64{0, size - openSubHashChunk} {
+		if _, err := r.Seek(off, io.SeekStart); err != nil {
+			return "", err
+		}
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return "", err
+		}
+		for i := 0; i < len(buf); i += 8 {
+			hash += binary.LittleEndian.Uint64(buf[i:])
+		}
+	}
+	return fmt.Sprintf("%016x", hash), nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestOpenSubHash(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+		set  map[int]byte // little-endian word starts and their low byte
+		want uint64
+	}{
+		{"zeros", 200000, nil, 200000},
+		{"both ends", 200000, map[int]byte{0: 1, 200000 - 8: 2}, 200000 + 3},
+		{"middle is skipped", 200000, map[int]byte{100000: 7}, 200000},
+		// Under 128 KiB the two chunks overlap and shared words count twice
+		{"overlapping chunks", 100000, map[int]byte{40000: 3}, 100000 + 6},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := make([]byte, tt.size)
+			for off, b := range tt.set {
+				data[off] = b
+			}
+			r := &readLog{ReadSeeker: bytes.NewReader(data)}
+
+			got, err := openSubHash(r, int64(len(data)))
+			if err != nil {
+				t.Fatalf("openSubHash() error = %v", err)
+			}
+			if want := fmt.Sprintf("%016x", tt.want); got != want {
+				t.Errorf("openSubHash() = %s, want %s", got, want)
+			}
+			if tt.size > 2*openSubHashChunk && r.touched(openSubHashChunk, int64(tt.size)-openSubHashChunk) {
+				t.Errorf("read outside the first and last 64 KiB")
+			}
+		})
+	}
+
+	if _, err := openSubHash(bytes.NewReader(make([]byte, 1000)), 1000); err == nil {
+		t.Error("expected an error for a file smaller than 64 KiB")
+	}
+}
+
+// fakeOpenSubtitles stands in for the parts of the OpenSubtitles API the
+// client uses. Results carry moviehash_match only when the request's
+// moviehash equals hash.
+func fakeOpenSubtitles(t *testing.T, hash string) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /subtitles", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Api-Key") != "test-key" {
+			http.Error(w, "bad key", http.StatusUnauthorized)
+			return
+		}
+		q := r.URL.Query()
+		if q.Get("query") == "" || q.Get("languages") != "en" {
+			t.Errorf("unexpected search parameters %v", q)
+		}
+		matched := hash != "" && q.Get("moviehash") == hash
+		w.Write([]byte(`{"data":[
+			{"attributes":{"language":"en","release":"Big.Movie.2019.1080p.BluRay.x264-GRP","ratings":9,"download_count":90000,
+				"files":[{"file_id":101,"file_name":"big.movie.srt"}]}},
+			{"attributes":{"language":"en","release":"Big Movie 2019 WEB","ratings":6,"download_count":12,"moviehash_match":` +
+			strconv.FormatBool(matched) + `,
+				"files":[{"file_id":202,"file_name":"big.movie.web.srt"}]}}
+		]}`))
+	})
+	mux.HandleFunc("POST /download", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			FileID int `json:"file_id"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		json.NewEncoder(w).Encode(map[string]string{
+			"link":      "http://" + r.Host + "/files/" + strconv.Itoa(req.FileID),
+			"file_name": "sub-" + map[int]string{101: "a", 202: "b"}[req.FileID] + ".srt",
+		})
+	})
+	mux.HandleFunc("GET /files/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("1\n00:00:01,000 --> 00:00:02,000\nHello\n"))
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestOpenSubClientMovieHash(t *testing.T) {
+	const hash = "8e245d9679d31e12"
+	srv := fakeOpenSubtitles(t, hash)
+	client := NewOpenSubClient(OpenSubOptions{APIKey: "test-key", BaseURL: srv.URL})
+	providers := SubtitleProviders{client}
+	query := "Big.Movie.2019.1080p.BluRay.x264-GRP"
+
+	// Without a hash the closer release name wins
+	results, err := providers.Search(SubtitleQuery{Text: query, Lang: "en"})
+	if err != nil {
+		t.Fatalf("Search() error = %v", err)
+	}
+	if len(results) != 2 || results[0].ID != "101" || results[0].HashMatch || results[1].HashMatch {
+		t.Fatalf("Search() without hash = %+v", results)
+	}
+
+	results, err = providers.Search(SubtitleQuery{Text: query, Lang: "en", MovieHash: hash})
+	if err != nil {
+		t.Fatalf("Search() error = %v", err)
+	}
+	if len(results) != 2 || results[0].ID != "202" || !results[0].HashMatch || results[0].Provider != "opensubtitles" {
+		t.Fatalf("Search() with hash = %+v", results)
+	}
+
+	content, name, err := client.Download(results[0].ID)
+	if err != nil {
+		t.Fatalf("Download() error = %v", err)
+	}
+	if name != "sub-b.srt" || !bytes.Contains(content, []byte("Hello")) {
+		t.Errorf("Download() = %q, %q", content, name)
+	}
+}
+
+func TestOpenSubClientLogin(t *testing.T) {
+	var (
+		mu        sync.Mutex
+		logins    int
+		valid     string // the only token the API host accepts
+		remaining = 9
+	)
+
+	// Login happens on the configured host, which hands out a different one
+	// for the API calls that follow
+	api := http.NewServeMux()
+	apiSrv := httptest.NewServer(api)
+	t.Cleanup(apiSrv.Close)
+
+	login := http.NewServeMux()
+	login.HandleFunc("POST /api/v1/login", func(w http.ResponseWriter, r *http.Request) {
+		var req struct{ Username, Password string }
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Username != "alice" || req.Password != "secret" {
+			http.Error(w, "bad credentials", http.StatusUnauthorized)
+			return
+		}
+		mu.Lock()
+		logins++
+		valid = fmt.Sprintf("tok-%d", logins)
+		token := valid
+		mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]string{"token": token, "base_url": apiSrv.Listener.Addr().String()})
+	})
+	loginSrv := httptest.NewServer(login)
+	t.Cleanup(loginSrv.Close)
+
+	api.HandleFunc("POST /api/v1/download", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Header.Get("Authorization") != "Bearer "+valid {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		resp := map[string]any{"remaining": remaining, "reset_time": "23 hours", "reset_time_utc": "2026-10-17T12:00:00.000Z"}
+		if remaining == 0 {
+			w.WriteHeader(http.StatusNotAcceptable)
+			resp["message"] = "You have downloaded your allowed 10 subtitles for 24h"
+		} else {
+			remaining--
+			resp["link"] = "http://" + r.Host + "/files/1"
+			resp["file_name"] = "movie.srt"
+		}
+		json.NewEncoder(w).Encode(resp)
+	})
+	api.HandleFunc("GET /files/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("1\n00:00:01,000 --> 00:00:02,000\nHello\n"))
+	})
+
+	client := NewOpenSubClient(OpenSubOptions{APIKey: "test-key", BaseURL: loginSrv.URL + "/api/v1", Username: "alice", Password: "secret"})
+
+	if _, _, err := client.Download("1"); err != nil {
+		t.Fatalf("first Download() error = %v", err)
+	}
+	quota, ok := client.Quota()
+	if !ok || quota.Remaining != 9 || quota.ResetTime != "23 hours" || quota.ResetAt == nil || quota.ResetAt.Day() != 17 {
+		t.Errorf("Quota() = %+v, %v", quota, ok)
+	}
+
+	// An expired token is replaced by logging in again
+	mu.Lock()
+	valid = "expired"
+	mu.Unlock()
+	if _, _, err := client.Download("1"); err != nil {
+		t.Fatalf("Download() after expiry error = %v", err)
+	}
+	mu.Lock()
+	if logins != 2 {
+		t.Errorf("logged in %d times, want 2", logins)
+	}
+	remaining = 0
+	mu.Unlock()
+	if _, _, err := client.Download("1"); !errors.Is(err, errSubtitleQuota) {
+		t.Fatalf("Download() with no quota error = %v, want errSubtitleQuota", err)
+	}
+	if quota, _ := client.Quota(); quota.Remaining != 0 {
+		t.Errorf("Quota().Remaining = %d, want 0", quota.Remaining)
+	}
+
+	bad := NewOpenSubClient(OpenSubOptions{APIKey: "test-key", BaseURL: loginSrv.URL + "/api/v1", Username: "alice", Password: "wrong"})
+	if _, _, err := bad.Download("1"); err == nil || !strings.Contains(err.Error(), "login") {
+		t.Errorf("Download() with bad credentials error = %v", err)
+	}
+}
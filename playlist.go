@@ -0,0 +1,90 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// Playlist is one season of a series, in episode order.
+type Playlist struct {
+	Title   string          `json:"title"`
+	Season  int             `json:"season,omitempty"`
+	Entries []PlaylistEntry `json:"entries"`
+}
+
+type PlaylistEntry struct {
+	FileIndex int    `json:"fileIndex"`
+	Episodes  []int  `json:"episodes"`
+	Path      string `json:"path"`
+}
+
+// buildPlaylists groups the video files that have episode numbers by series
+// and season. Playlists are ordered by title and season, and their entries
+// by episode, with the path breaking ties between copies of an episode.
+func buildPlaylists(files []FileInfo) []Playlist {
+	type key struct {
+		title  string
+		season int
+	}
+	index := make(map[key]int)
+	var playlists []Playlist
+	for _, f := range files {
+		if !f.IsVideo || f.Media == nil || len(f.Media.Episodes) == 0 {
+			continue
+		}
+		k := key{strings.ToLower(f.Media.Title), f.Media.Season}
+		i, ok := index[k]
+		if !ok {
+			i = len(playlists)
+			index[k] = i
+			playlists = append(playlists, Playlist{Title: f.Media.Title, Season: f.Media.Season})
+		}
+		playlists[i].Entries = append(playlists[i].Entries, PlaylistEntry{
+			FileIndex: f.Index,
+			Episodes:  f.Media.Episodes,
+			Path:      f.Path,
+		})
+	}
+
+	for _, p := range playlists {
+		sort.SliceStable(p.Entries, func(i, j int) bool {
+			a, b := p.Entries[i], p.Entries[j]
+			if a.Episodes[0] != b.Episodes[0] {
+				return a.Episodes[0] < b.Episodes[0]
+			}
+			return a.Path < b.Path
+		})
+	}
+	sort.SliceStable(playlists, func(i, j int) bool {
+		a, b := strings.ToLower(playlists[i].Title), strings.ToLower(playlists[j].Title)
+		if a != b {
+			return a < b
+		}
+		return playlists[i].Season < playlists[j].Season
+	})
+	return playlists
+}
+
+// nextEpisode returns the file to play after fileIndex: the next episode of
+// its season, skipping other copies of episodes already covered, or else the
+// first episode of the series' next season.
+func nextEpisode(playlists []Playlist, fileIndex int) (int, bool) {
+	for pi, p := range playlists {
+		for ei, e := range p.Entries {
+			if e.FileIndex != fileIndex {
+				continue
+			}
+			last := e.Episodes[len(e.Episodes)-1]
+			for _, next := range p.Entries[ei+1:] {
+				if next.Episodes[0] > last {
+					return next.FileIndex, true
+				}
+			}
+			if pi+1 < len(playlists) && strings.EqualFold(playlists[pi+1].Title, p.Title) {
+				return playlists[pi+1].Entries[0].FileIndex, true
+			}
+			return -1, false
+		}
+	}
+	return -1, false
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBuildPlaylists(t *testing.T) {
+	const pack = "Show.Name.Complete.1080p.BluRay.x264-GRP"
+	paths := []string{
+		"Season 2/Show.Name.S02E01.mkv",
+		"Season 1/Show.Name.S01E10.mkv",
+		"Season 1/Show.Name.S01E02.mkv",
+		"Season 1/Show.Name.S01E01.mkv",
+		"Season 1/Show.Name.S01E01.720p.mkv", // another copy of episode 1
+		"Season 1/Show.Name.S01E03E04.mkv",
+		"Show.Name.S01E02.srt",
+		"Sample/sample.mkv",
+		"Other.Show.S01E01.mkv",
+	}
+	var files []FileInfo
+	for i, p := range paths {
+		f := FileInfo{Index: i, Path: p, IsVideo: p[len(p)-4:] == ".mkv"}
+		if f.IsVideo {
+			media := mediaInfoFor(pack, p)
+			f.Media = &media
+		}
+		files = append(files, f)
+	}
+
+	playlists := buildPlaylists(files)
+	type season struct {
+		title   string
+		season  int
+		indexes []int
+	}
+	var got []season
+	for _, p := range playlists {
+		s := season{title: p.Title, season: p.Season}
+		for _, e := range p.Entries {
+			s.indexes = append(s.indexes, e.FileIndex)
+		}
+		got = append(got, s)
+	}
+	want := []season{
+		{"Other Show", 1, []int{8}},
+		{"Show Name", 1, []int{4, 3, 2, 5, 1}},
+		{"Show Name", 2, []int{0}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("buildPlaylists() = %+v, want %+v", got, want)
+	}
+
+	for _, tt := range []struct {
+		file, next int
+	}{
+		{4, 2}, // the other copy of episode 1 is skipped
+		{3, 2},
+		{5, 1}, // E03E04 is followed by E10
+		{1, 0}, // the end of season 1 moves on to season 2
+		{0, -1},
+		{8, -1}, // other series are not joined on
+		{7, -1},
+	} {
+		if next, _ := nextEpisode(playlists, tt.file); next != tt.next {
+			t.Errorf("nextEpisode(%d) = %d, want %d", tt.file, next, tt.next)
+		}
+	}
+}
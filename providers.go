@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// SubtitleProvider is a source of subtitles that can be searched and
+// downloaded from. IDs in search results are only meaningful to the
+// provider that returned them.
+type SubtitleProvider interface {
+	Name() string
+	Search(q SubtitleQuery) ([]SubSearchResult, error)
+	Download(id string) (content []byte, fileName string, err error)
+}
+
+// SubtitleQuotaReporter is implemented by providers that limit downloads.
+// Quota reports the allowance left after the most recent download.
+type SubtitleQuotaReporter interface {
+	Quota() (SubtitleQuota, bool)
+}
+
+// SubtitleQuery describes the video subtitles are wanted for. Providers use
+// whichever fields they support.
+type SubtitleQuery struct {
+	Text      string // free text, usually the title
+	Lang      string
+	MovieHash string // OpenSubtitles hash of the video file, see openSubHash
+	Year      int
+	Season    int
+	Episode   int
+
+	// Release is the full release name. Results are ranked against it when
+	// set, so ones for the same source and group come first.
+	Release string
+}
+
+// subtitleQueryFor builds the query for a video from its release name.
+func subtitleQueryFor(release string, media MediaInfo, lang string) SubtitleQuery {
+	q := SubtitleQuery{
+		Text:    media.Title,
+		Lang:    lang,
+		Year:    media.Year,
+		Season:  media.Season,
+		Episode: media.Episode(),
+		Release: release,
+	}
+	if q.Text == "" {
+		q.Text = release
+	}
+	return q
+}
+
+// SubtitleProviders fans searches out to every configured provider.
+type SubtitleProviders []SubtitleProvider
+
+// Provider returns the provider with the given name.
+func (ps SubtitleProviders) Provider(name string) (SubtitleProvider, bool) {
+	for _, p := range ps {
+		if p.Name() == name {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// Search queries all providers concurrently and returns their merged results,
+// tagged with the provider and ranked best first. Failing providers are
+// logged and skipped; an error is returned only if every provider fails.
+func (ps SubtitleProviders) Search(q SubtitleQuery) ([]SubSearchResult, error) {
+	if len(ps) == 0 {
+		return nil, fmt.Errorf("no subtitle providers configured")
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		results []SubSearchResult
+		errs    []error
+	)
+	for _, p := range ps {
+		wg.Add(1)
+		go func(p SubtitleProvider) {
+			defer wg.Done()
+			found, err := p.Search(q)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				log.Printf("subtitle search on %s: %v", p.Name(), err)
+				errs = append(errs, fmt.Errorf("%s: %w", p.Name(), err))
+				return
+			}
+			for _, r := range found {
+				r.Provider = p.Name()
+				results = append(results, r)
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	if len(errs) == len(ps) {
+		return nil, errors.Join(errs...)
+	}
+	rankSubtitles(q, results)
+	return results, nil
+}
+
+// rankSubtitles scores results by how many query words their release or file
+// name contains, with download count and rating as tie breakers, and sorts
+// them best first. Score is comparable across providers. Results matched by
+// movie hash were made for this exact file, so they come first regardless.
+func rankSubtitles(q SubtitleQuery, results []SubSearchResult) {
+	query := q.Release
+	if query == "" {
+		query = q.Text
+	}
+	words := searchWords(query)
+	maxDownloads := 0
+	for _, r := range results {
+		maxDownloads = max(maxDownloads, r.Downloads)
+	}
+
+	for i := range results {
+		r := &results[i]
+		match := 1.0
+		if len(words) > 0 {
+			have := map[string]bool{}
+			for _, w := range searchWords(r.Release + " " + r.FileName) {
+				have[w] = true
+			}
+			hits := 0
+			for _, w := range words {
+				if have[w] {
+					hits++
+				}
+			}
+			match = float64(hits) / float64(len(words))
+		}
+
+		popularity := 0.0
+		if maxDownloads > 0 {
+			popularity = math.Log1p(float64(r.Downloads)) / math.Log1p(float64(maxDownloads))
+		}
+		r.Score = math.Round((0.7*match+0.2*popularity+0.1*min(r.Rating, 10)/10)*1000) / 1000
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].HashMatch != results[j].HashMatch {
+			return results[i].HashMatch
+		}
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Downloads > results[j].Downloads
+	})
+}
+
+// searchWords lowercases s and splits it on anything but letters and digits,
+// so "Show.Name.S01E02" and "show name s01e02" compare equal.
+func searchWords(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type fakeProvider struct {
+	name    string
+	results []SubSearchResult
+	err     error
+}
+
+func (p fakeProvider) Name() string { return p.name }
+
+func (p fakeProvider) Search(q SubtitleQuery) ([]SubSearchResult, error) {
+	return p.results, p.err
+}
+
+func (p fakeProvider) Download(id string) ([]byte, string, error) {
+	return nil, "", errors.New("not implemented")
+}
+
+// queryRecorder is a provider that records the queries it is sent.
+type queryRecorder struct {
+	fakeProvider
+	queries chan SubtitleQuery
+}
+
+func (p queryRecorder) Search(q SubtitleQuery) ([]SubSearchResult, error) {
+	p.queries <- q
+	return p.fakeProvider.Search(q)
+}
+
+func writeSubtitleDir(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		full := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(full), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(full, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestSubtitleProvidersSearch(t *testing.T) {
+	dir := writeSubtitleDir(t, map[string]string{
+		"Big.Movie.2019.en.srt":          "1\n00:00:01,000 --> 00:00:02,000\nHello\n",
+		"Big.Movie.2019.de.srt":          "1\n00:00:01,000 --> 00:00:02,000\nHallo\n",
+		"Other.Film.2001/Other.Film.vtt": "WEBVTT\n",
+		"notes.txt":                      "not a subtitle",
+	})
+
+	providers := SubtitleProviders{
+		NewLocalSubtitleProvider(dir),
+		fakeProvider{name: "broken", err: errors.New("service unavailable")},
+		fakeProvider{name: "remote", results: []SubSearchResult{
+			{ID: "1", Release: "Big Movie 2019 1080p BluRay", Language: "en", Downloads: 5000, Rating: 8},
+			{ID: "2", Release: "Unrelated Show S01E01", Language: "en", Downloads: 90000, Rating: 9},
+		}},
+	}
+
+	results, err := providers.Search(SubtitleQuery{Text: "Big.Movie.2019.1080p.BluRay.x264-GRP", Lang: "en"})
+	if err != nil {
+		t.Fatalf("Search() error = %v", err)
+	}
+
+	var got []string
+	for _, r := range results {
+		got = append(got, r.Provider+":"+r.ID)
+	}
+	want := []string{"remote:1", "local:Big.Movie.2019.en.srt", "remote:2"}
+	if len(got) != len(want) {
+		t.Fatalf("Search() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("Search() = %v, want %v", got, want)
+		}
+	}
+	for i := 1; i < len(results); i++ {
+		if results[i].Score > results[i-1].Score {
+			t.Errorf("results not sorted by score: %v", results)
+		}
+	}
+
+	content, name, err := providers[0].Download(results[1].ID)
+	if err != nil {
+		t.Fatalf("Download() error = %v", err)
+	}
+	if name != "Big.Movie.2019.en.srt" || string(content) != "1\n00:00:01,000 --> 00:00:02,000\nHello\n" {
+		t.Errorf("Download() = %q, %q", content, name)
+	}
+}
+
+func TestSubtitleProvidersAllFail(t *testing.T) {
+	providers := SubtitleProviders{
+		fakeProvider{name: "a", err: errors.New("down")},
+		fakeProvider{name: "b", err: errors.New("down")},
+	}
+	if _, err := providers.Search(SubtitleQuery{Text: "anything", Lang: "en"}); err == nil {
+		t.Fatal("expected an error when every provider fails")
+	}
+	if _, err := SubtitleProviders(nil).Search(SubtitleQuery{Text: "anything", Lang: "en"}); err == nil {
+		t.Fatal("expected an error with no providers")
+	}
+}
+
+func TestLocalSubtitleProviderDownloadRejectsEscapes(t *testing.T) {
+	root := writeSubtitleDir(t, map[string]string{
+		"secret.srt":    "outside",
+		"subs/good.srt": "inside",
+	})
+	p := NewLocalSubtitleProvider(filepath.Join(root, "subs"))
+
+	for _, id := range []string{"../secret.srt", "/etc/passwd.srt", "sub/../../secret.srt", "good.txt", ""} {
+		if _, _, err := p.Download(id); err == nil {
+			t.Errorf("Download(%q) succeeded, want error", id)
+		}
+	}
+	if content, _, err := p.Download("good.srt"); err != nil || string(content) != "inside" {
+		t.Errorf("Download(good.srt) = %q, %v", content, err)
+	}
+}
+
+func TestLocalSubtitleProviderEpisodes(t *testing.T) {
+	dir := writeSubtitleDir(t, map[string]string{
+		"Show.Name.S01E01.en.srt":   "",
+		"Show.Name.S01E02.en.srt":   "",
+		"Show.Name.S02/02.en.srt":   "",
+		"Show.Name.Specials.en.srt": "",
+	})
+	p := NewLocalSubtitleProvider(dir)
+
+	q := subtitleQueryFor("Show.Name.S01E02.1080p.WEB-DL-GRP", ParseRelease("Show.Name.S01E02.1080p.WEB-DL-GRP"), "en")
+	results, err := p.Search(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range results {
+		got = append(got, r.ID)
+	}
+	// Files that don't name an episode can't be ruled out
+	want := []string{"Show.Name.S01E02.en.srt", "Show.Name.Specials.en.srt"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Search() = %v, want %v", got, want)
+	}
+}
+
+func TestSearchSubtitlesWithoutMovieHash(t *testing.T) {
+	m := newTestManager(t)
+	mt := addTestTorrent(t, m, 1<<16, testFile{path: "Big.Movie.2019.1080p.mp4", length: 1 << 20})
+	if _, err := m.SelectFile(mt.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	provider := queryRecorder{fakeProvider{name: "opensubtitles"}, make(chan SubtitleQuery, 1)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/subtitles/{torrentId}", handleSearchSubtitles(m, SubtitleProviders{provider}))
+
+	// No piece of the video can arrive, so the hash never completes
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/api/subtitles/"+mt.ID, nil))
+	if elapsed := time.Since(start); elapsed > movieHashTimeout/4 {
+		t.Errorf("search took %v", elapsed)
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", rec.Code, rec.Body)
+	}
+	if q := <-provider.queries; q.MovieHash != "" || q.Text == "" {
+		t.Errorf("query = %+v, want a text search without a hash", q)
+	}
+}
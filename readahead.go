@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Adaptive readahead stays within these bounds, and never exceeds the file.
+const (
+	minAdaptiveReadahead = 4 << 20
+	maxAdaptiveReadahead = 512 << 20
+)
+
+// maxSlowSwarmFactor caps how much readahead grows when the swarm is slower
+// than playback.
+const maxSlowSwarmFactor = 4
+
+// readahead returns how far ahead of the playhead to fetch fileIndex. Once
+// the video's duration is known it covers BufferTarget of playback at the
+// file's average bitrate; until then, or with BufferTarget 0, the size tiers
+// apply. Callers must hold mt.mu.
+func (m *TorrentManager) readahead(mt *ManagedTorrent, fileIndex int) int64 {
+	f := mt.Files[fileIndex]
+	if m.cfg.BufferTarget <= 0 || f.Duration <= 0 {
+		return m.cfg.readaheadFor(f.Length)
+	}
+	duration := time.Duration(f.Duration * float64(time.Second))
+	return adaptiveReadahead(f.Length, duration, mt.rate.Down, time.Duration(m.cfg.BufferTarget))
+}
+
+// adaptiveReadahead sizes readahead to hold target of playback for a file of
+// size bytes lasting duration. When the torrent downloads slower than the
+// bitrate, more pieces are requested at once so more peers can contribute.
+func adaptiveReadahead(size int64, duration time.Duration, downRate float64, target time.Duration) int64 {
+	bitrate := float64(size) / duration.Seconds() // bytes per second
+	readahead := bitrate * target.Seconds()
+	if downRate > 0 && downRate < bitrate {
+		readahead *= min(bitrate/downRate, maxSlowSwarmFactor)
+	}
+	return int64(min(max(readahead, minAdaptiveReadahead), maxAdaptiveReadahead, float64(size)))
+}
+
+// durationReaders read a video's duration from its container, by
+// extension.
+var durationReaders = map[string]func(io.ReadSeeker, int64) (time.Duration, error){
+	".mkv":  mkvDuration,
+	".webm": mkvDuration,
+	".mp4":  mp4Duration,
+	".m4v":  mp4Duration,
+	".mov":  mp4Duration,
+}
+
+// probeDuration reads the video's duration from its container and records
+// it on the file. It is meant to run once the ends of the file are present,
+// where the container metadata usually lives.
+func (m *TorrentManager) probeDuration(ctx context.Context, mt *ManagedTorrent, fileIndex int) {
+	file := mt.Torrent.Files()[fileIndex]
+	readDuration, ok := durationReaders[strings.ToLower(filepath.Ext(file.DisplayPath()))]
+	if !ok {
+		return
+	}
+	reader := file.NewReader()
+	defer reader.Close()
+	reader.SetContext(ctx)
+	reader.SetReadahead(0)
+	reader.SetResponsive()
+
+	duration, err := readDuration(reader, file.Length())
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("duration of %s: %v", file.DisplayPath(), err)
+		}
+		return
+	}
+
+	mt.mu.Lock()
+	mt.Files[fileIndex].Duration = duration.Seconds()
+	mt.mu.Unlock()
+}
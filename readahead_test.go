@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveReadahead(t *testing.T) {
+	const target = time.Minute
+	tests := []struct {
+		name     string
+		size     int64
+		duration time.Duration
+		downRate float64
+		want     int64
+	}{
+		// 60 Mbps is 7.5 MB/s; a minute of it, fourfold for a slow swarm,
+		// is over the cap
+		{"remux on slow swarm", 45 << 30, 100 * time.Minute, 1 << 20, maxAdaptiveReadahead},
+		{"remux on fast swarm", 6000 << 20, 100 * time.Minute, 100 << 20, 60 << 20},
+		{"slow swarm at half the bitrate", 6000 << 20, 100 * time.Minute, 512 << 10, 120 << 20},
+		{"unknown rate", 6000 << 20, 100 * time.Minute, 0, 60 << 20},
+		{"SD file", 200 << 20, 100 * time.Minute, 100 << 20, minAdaptiveReadahead},
+		{"short clip", 1 << 20, time.Second, 0, 1 << 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := adaptiveReadahead(tt.size, tt.duration, tt.downRate, target); got != tt.want {
+				t.Errorf("adaptiveReadahead() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func mp4Box(typ string, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	box := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+	return append(append(box, typ...), body...)
+}
+
+func TestVideoDuration(t *testing.T) {
+	mvhd0 := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd0[12:], 1000)
+	binary.BigEndian.PutUint32(mvhd0[16:], 5400500)
+	mvhd1 := make([]byte, 112)
+	mvhd1[0] = 1
+	binary.BigEndian.PutUint32(mvhd1[20:], 90000)
+	binary.BigEndian.PutUint64(mvhd1[24:], 90000*42)
+
+	// A 64-bit sized mdat ahead of the moov
+	mdat := binary.BigEndian.AppendUint32(nil, 1)
+	mdat = append(mdat, "mdat"...)
+	mdat = binary.BigEndian.AppendUint64(mdat, 16+4096)
+	mdat = append(mdat, make([]byte, 4096)...)
+
+	mkvInfoWith := func(duration []byte) []byte {
+		segment := ebmlElem(mkvSegment, ebmlElem(mkvInfo,
+			ebmlUintElem(mkvTimecodeScale, 1000000), ebmlElem(mkvSegmentDuration, duration)))
+		return append(ebmlElem(mkvEBML, ebmlElem(mkvDocType, []byte("matroska"))), segment...)
+	}
+
+	tests := []struct {
+		name string
+		ext  string
+		data []byte
+		want time.Duration
+	}{
+		{"mp4 moov first", ".mp4", append(mp4Box("ftyp", []byte("isom")), mp4Box("moov", mp4Box("mvhd", mvhd0))...), 5400500 * time.Millisecond},
+		{"mp4 moov last", ".mov", bytes.Join([][]byte{mp4Box("ftyp"), mdat, mp4Box("moov", mp4Box("trak"), mp4Box("mvhd", mvhd1))}, nil), 42 * time.Second},
+		{"mkv float64", ".mkv", mkvInfoWith(binary.BigEndian.AppendUint64(nil, math.Float64bits(90500))), 90500 * time.Millisecond},
+		{"mkv float32", ".webm", mkvInfoWith(binary.BigEndian.AppendUint32(nil, math.Float32bits(1500))), 1500 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &readLog{ReadSeeker: bytes.NewReader(tt.data)}
+			got, err := durationReaders[tt.ext](r, int64(len(tt.data)))
+			if err != nil {
+				t.Fatalf("duration error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("duration = %v, want %v", got, tt.want)
+			}
+			if tt.ext == ".mov" && r.touched(8+16, 8+16+4096) {
+				t.Error("read the media data")
+			}
+		})
+	}
+
+	if _, err := mp4Duration(bytes.NewReader(mp4Box("ftyp")), 8); err == nil {
+		t.Error("expected an error for an MP4 without moov")
+	}
+}
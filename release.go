@@ -0,0 +1,332 @@
+package main
+
+import (
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// MediaInfo is what a scene-style release name says about a video, e.g.
+// "Show.Name.S01E02.1080p.WEB-DL.DDP5.1.x264-GROUP".
+type MediaInfo struct {
+	Title      string   `json:"title,omitempty"`
+	Year       int      `json:"year,omitempty"`
+	Season     int      `json:"season,omitempty"`
+	Episodes   []int    `json:"episodes,omitempty"`
+	Resolution string   `json:"resolution,omitempty"`
+	Source     string   `json:"source,omitempty"`
+	Codec      string   `json:"codec,omitempty"`
+	Audio      string   `json:"audio,omitempty"`
+	HDR        []string `json:"hdr,omitempty"`
+	Group      string   `json:"group,omitempty"`
+}
+
+// Episode returns the first episode number, or 0 for a movie or season pack.
+func (m MediaInfo) Episode() int {
+	if len(m.Episodes) == 0 {
+		return 0
+	}
+	return m.Episodes[0]
+}
+
+// releaseTag matches one kind of tag in a release name and maps the match to
+// its canonical spelling. Tags must stand alone between separators.
+type releaseTag struct {
+	re        *regexp.Regexp
+	canonical func(m []string) string
+}
+
+func tagPattern(expr string) *regexp.Regexp {
+	return regexp.MustCompile(`(?i)(?:^|[\s._\-\[\(])(` + expr + `)(?:$|[\s._\-\]\)])`)
+}
+
+func fixed(s string) func([]string) string { return func([]string) string { return s } }
+
+var (
+	episodeTag    = tagPattern(`S(\d{1,2})[ ._-]?((?:E\d{1,4}(?:-E?\d{1,4})?[ ._-]?)+)`)
+	crossTag      = tagPattern(`(\d{1,2})x(\d{2,3})`)
+	seasonTag     = tagPattern(`S(\d{1,2})|Season[ ._-]?(\d{1,2})`)
+	animeEpisode  = regexp.MustCompile(`\s-\s(\d{1,4})(?:v\d)?(?:\s|$)`)
+	yearTag       = tagPattern(`(?:19|20)\d{2}`)
+	episodeNumber = regexp.MustCompile(`(?i)(\d+)(?:-E?(\d+))?`)
+	groupSuffix   = regexp.MustCompile(`-([A-Za-z0-9]+)(?:\s*\[[^\]]*\])*$`)
+	groupPrefix   = regexp.MustCompile(`^\[([^\]]+)\]\s*`)
+	crcSuffix     = regexp.MustCompile(`\s*\[[0-9A-Fa-f]{8}\]$`)
+
+	resolutionTags = []releaseTag{
+		{tagPattern(`2160p|4K|UHD`), fixed("2160p")},
+		{tagPattern(`1080[pi]`), func(m []string) string { return strings.ToLower(m[1]) }},
+		{tagPattern(`720p|576p|480p`), func(m []string) string { return strings.ToLower(m[1]) }},
+	}
+	sourceTags = []releaseTag{
+		{tagPattern(`Remux`), fixed("Remux")},
+		{tagPattern(`Blu-?Ray|BDRip|BRRip|BDRemux`), fixed("BluRay")},
+		{tagPattern(`WEB-?DL|WEB`), fixed("WEB-DL")},
+		{tagPattern(`WEB-?Rip`), fixed("WEBRip")},
+		{tagPattern(`HDTV|PDTV`), fixed("HDTV")},
+		{tagPattern(`DVD-?Rip|DVD`), fixed("DVD")},
+		{tagPattern(`HDRip`), fixed("HDRip")},
+		{tagPattern(`(?-i:CAM|HDCAM|TS|TELESYNC)`), fixed("CAM")}, // case matters: "Cam" may be a title word
+	}
+	codecTags = []releaseTag{
+		{tagPattern(`[xh]\.?265|HEVC`), fixed("H.265")},
+		{tagPattern(`[xh]\.?264|AVC`), fixed("H.264")},
+		{tagPattern(`AV1`), fixed("AV1")},
+		{tagPattern(`VP9`), fixed("VP9")},
+		{tagPattern(`XviD`), fixed("XviD")},
+		{tagPattern(`DivX`), fixed("DivX")},
+	}
+	audioTag = tagPattern(`(DDP|DD\+|E-?AC-?3|DD|AC-?3|DTS-HD[ ._]?MA|DTS-HD|DTS-?X|DTS|TrueHD|AAC|FLAC|OPUS|MP3|LPCM)(?:[ ._]?([1-7][ ._]\d))?`)
+	atmosTag = tagPattern(`Atmos`)
+	hdrTags  = []releaseTag{
+		{tagPattern(`HDR10\+|HDR10Plus`), fixed("HDR10+")},
+		{tagPattern(`HDR10`), fixed("HDR10")},
+		{tagPattern(`HDR`), fixed("HDR")},
+		{tagPattern(`DV|DoVi|Dolby[ ._]Vision`), fixed("DV")},
+		{tagPattern(`HLG`), fixed("HLG")},
+	}
+
+	audioNames = map[string]string{
+		"DDP": "DDP", "DD+": "DDP", "EAC3": "DDP", "E-AC3": "DDP", "EAC-3": "DDP", "E-AC-3": "DDP",
+		"DD": "DD", "AC3": "DD", "AC-3": "DD",
+		"DTS-HDMA": "DTS-HD MA", "DTS-HD MA": "DTS-HD MA", "DTS-HD.MA": "DTS-HD MA", "DTS-HD_MA": "DTS-HD MA",
+		"DTS-HD": "DTS-HD", "DTS-X": "DTS:X", "DTSX": "DTS:X", "DTS": "DTS",
+		"TRUEHD": "TrueHD", "AAC": "AAC", "FLAC": "FLAC", "OPUS": "Opus", "MP3": "MP3", "LPCM": "LPCM",
+	}
+)
+
+// ParseRelease extracts media metadata from a release or file name. The
+// title is whatever comes before the first recognised tag. Fields the name
+// doesn't mention are left empty.
+func ParseRelease(name string) MediaInfo {
+	var info MediaInfo
+	name = strings.TrimSpace(crcSuffix.ReplaceAllString(name, ""))
+	if m := groupPrefix.FindStringSubmatch(name); m != nil {
+		info.Group = m[1]
+		name = name[len(m[0]):]
+	}
+
+	// titleEnd is where the first tag starts
+	titleEnd := len(name)
+	mark := func(loc []int) {
+		if loc != nil && loc[2] < titleEnd {
+			titleEnd = loc[2]
+		}
+	}
+
+	if loc := episodeTag.FindStringSubmatchIndex(name); loc != nil {
+		info.Season, _ = strconv.Atoi(name[loc[4]:loc[5]])
+		info.Episodes = parseEpisodeList(name[loc[6]:loc[7]])
+		mark(loc)
+	} else if loc := crossTag.FindStringSubmatchIndex(name); loc != nil {
+		info.Season, _ = strconv.Atoi(name[loc[4]:loc[5]])
+		ep, _ := strconv.Atoi(name[loc[6]:loc[7]])
+		info.Episodes = []int{ep}
+		mark(loc)
+	} else if loc := seasonTag.FindStringSubmatchIndex(name); loc != nil {
+		for g := 4; g < 8; g += 2 {
+			if loc[g] >= 0 {
+				info.Season, _ = strconv.Atoi(name[loc[g]:loc[g+1]])
+			}
+		}
+		mark(loc)
+	} else if loc := animeEpisode.FindStringSubmatchIndex(name); loc != nil && info.Group != "" {
+		ep, _ := strconv.Atoi(name[loc[2]:loc[3]])
+		info.Episodes = []int{ep}
+		titleEnd = loc[0]
+	}
+
+	var loc []int
+	info.Resolution, loc = matchReleaseTag(name, resolutionTags)
+	mark(loc)
+	info.Source, loc = matchReleaseTag(name, sourceTags)
+	mark(loc)
+	info.Codec, loc = matchReleaseTag(name, codecTags)
+	mark(loc)
+
+	// The year is the last one before the other tags, so the year in
+	// "2001.A.Space.Odyssey.1968" or "Blade.Runner.2049.2017" is the right
+	// one. Matches overlap on separators, hence the manual loop.
+	yearStart := -1
+	for pos := 0; pos < titleEnd; {
+		loc := yearTag.FindStringSubmatchIndex(name[pos:])
+		if loc == nil || pos+loc[2] >= titleEnd {
+			break
+		}
+		if pos+loc[2] > 0 {
+			yearStart = pos + loc[2]
+		}
+		pos += loc[3]
+	}
+	if yearStart > 0 {
+		info.Year, _ = strconv.Atoi(name[yearStart : yearStart+4])
+		titleEnd = yearStart
+	}
+
+	// Short tags like "DV" or "DD" are common words in titles, so only look
+	// for them after the title
+	rest := name[titleEnd:]
+	if m := audioTag.FindStringSubmatch(rest); m != nil {
+		codec := strings.ToUpper(m[2])
+		info.Audio = audioNames[codec]
+		if info.Audio == "" {
+			info.Audio = m[2]
+		}
+		if m[3] != "" {
+			info.Audio += " " + m[3][:1] + "." + m[3][2:]
+		}
+	}
+	if atmosTag.MatchString(rest) {
+		info.Audio = strings.TrimSpace(info.Audio + " Atmos")
+	}
+	// HDR10+ implies HDR10 implies HDR, so only the most specific is kept
+	if hdr, _ := matchReleaseTag(rest, hdrTags[:3]); hdr != "" {
+		info.HDR = append(info.HDR, hdr)
+	}
+	for _, tag := range hdrTags[3:] {
+		if tag.re.MatchString(rest) {
+			info.HDR = append(info.HDR, tag.canonical(nil))
+		}
+	}
+	if info.Group == "" && titleEnd < len(name) {
+		if loc := groupSuffix.FindStringSubmatchIndex(name); loc != nil {
+			// Skip the second half of tags like "WEB-DL" or "DTS-HD"
+			prev := name[strings.LastIndexAny(name[:loc[0]], " ._-[(")+1 : loc[3]]
+			if group := name[loc[2]:loc[3]]; !isDigitsOnly(group) && !isReleaseTag(prev) {
+				info.Group = group
+			}
+		}
+	}
+
+	info.Title = cleanTitle(name[:titleEnd])
+	return info
+}
+
+// matchReleaseTag returns the canonical value of the earliest match of any
+// of tags, and its submatch index, or nil if none match. The earlier tag wins
+// when two match at the same place.
+func matchReleaseTag(name string, tags []releaseTag) (string, []int) {
+	var (
+		value string
+		first []int
+	)
+	for _, tag := range tags {
+		m := tag.re.FindStringSubmatchIndex(name)
+		if m == nil || (first != nil && m[2] >= first[2]) {
+			continue
+		}
+		groups := make([]string, len(m)/2)
+		for i := range groups {
+			if m[2*i] >= 0 {
+				groups[i] = name[m[2*i]:m[2*i+1]]
+			}
+		}
+		value, first = tag.canonical(groups), m
+	}
+	return value, first
+}
+
+// parseEpisodeList reads "E01E02", "E01-E03" or "E01-03" as episode numbers,
+// expanding ranges.
+func parseEpisodeList(s string) []int {
+	var episodes []int
+	for _, m := range episodeNumber.FindAllStringSubmatch(s, -1) {
+		from, _ := strconv.Atoi(m[1])
+		to := from
+		if m[2] != "" {
+			to, _ = strconv.Atoi(m[2])
+		}
+		// Guard against "E01-E999" style typos expanding to huge lists
+		if to < from || to-from > 50 {
+			to = from
+		}
+		for ep := from; ep <= to; ep++ {
+			episodes = append(episodes, ep)
+		}
+	}
+	return episodes
+}
+
+// isReleaseTag reports whether the whole of s is a single tag.
+func isReleaseTag(s string) bool {
+	whole := func(re *regexp.Regexp) bool {
+		loc := re.FindStringSubmatchIndex(s)
+		return loc != nil && loc[2] == 0 && loc[3] == len(s)
+	}
+	if whole(audioTag) || whole(atmosTag) {
+		return true
+	}
+	for _, tags := range [][]releaseTag{resolutionTags, sourceTags, codecTags, hdrTags} {
+		for _, tag := range tags {
+			if whole(tag.re) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// cleanTitle turns separators into spaces and drops leftover brackets.
+func cleanTitle(s string) string {
+	s = strings.NewReplacer(".", " ", "_", " ").Replace(s)
+	s = strings.Join(strings.Fields(s), " ")
+	return strings.Trim(s, " -([{")
+}
+
+// mediaInfoFor parses the name of a video file, filling in what the file
+// name lacks from its folders and then the torrent name. Season packs often
+// name episode files just "01.mkv" inside "Show.S01.1080p.BluRay-GROUP".
+func mediaInfoFor(torrentName, filePath string) MediaInfo {
+	info := ParseRelease(stripExt(path.Base(filePath)))
+	if len(info.Episodes) == 0 && isDigitsOnly(info.Title) && len(info.Title) <= 3 {
+		// "01.mkv" is episode 1 of whatever season the folder is
+		ep, _ := strconv.Atoi(info.Title)
+		info.Title, info.Episodes = "", []int{ep}
+	}
+	parents := strings.Split(path.Dir(filePath), "/")
+	if parents[0] == "." {
+		parents = nil
+	}
+	names := append([]string{torrentName}, parents...)
+	for i := len(names) - 1; i >= 0; i-- {
+		info.fillFrom(ParseRelease(names[i]))
+	}
+	if info.Title == "" {
+		info.Title = ParseRelease(torrentName).Title
+	}
+	return info
+}
+
+// fillFrom copies the fields of o that m is missing. The title is only taken
+// from names that look like releases, not from folders like "Extras".
+func (m *MediaInfo) fillFrom(o MediaInfo) {
+	tagged := o.Year != 0 || o.Season != 0 || o.Resolution != "" || o.Source != "" || o.Codec != ""
+	if m.Title == "" && tagged {
+		m.Title = o.Title
+	}
+	if m.Year == 0 {
+		m.Year = o.Year
+	}
+	if m.Season == 0 {
+		m.Season = o.Season
+	}
+	if m.Resolution == "" {
+		m.Resolution = o.Resolution
+	}
+	if m.Source == "" {
+		m.Source = o.Source
+	}
+	if m.Codec == "" {
+		m.Codec = o.Codec
+	}
+	if m.Audio == "" {
+		m.Audio = o.Audio
+	}
+	if len(m.HDR) == 0 {
+		m.HDR = o.HDR
+	}
+	if m.Group == "" {
+		m.Group = o.Group
+	}
+}
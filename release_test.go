@@ -0,0 +1,66 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRelease(t *testing.T) {
+	tests := []struct {
+		name string
+		want MediaInfo
+	}{
+		{"Show.Name.S01E02.1080p.WEB-DL.DDP5.1.x264-GROUP", MediaInfo{
+			Title: "Show Name", Season: 1, Episodes: []int{2}, Resolution: "1080p", Source: "WEB-DL", Codec: "H.264", Audio: "DDP 5.1", Group: "GROUP",
+		}},
+		{"Show Name - S02E05E06 - Title 720p HDTV x265-GRP", MediaInfo{
+			Title: "Show Name", Season: 2, Episodes: []int{5, 6}, Resolution: "720p", Source: "HDTV", Codec: "H.265", Group: "GRP",
+		}},
+		{"Show.S03E01-E03.720p", MediaInfo{Title: "Show", Season: 3, Episodes: []int{1, 2, 3}, Resolution: "720p"}},
+		{"Show.3x07.HDTV.XviD-LOL", MediaInfo{Title: "Show", Season: 3, Episodes: []int{7}, Source: "HDTV", Codec: "XviD", Group: "LOL"}},
+		{"The.Office.US.S03.Complete.720p.BluRay.x264-DEMAND", MediaInfo{
+			Title: "The Office US", Season: 3, Resolution: "720p", Source: "BluRay", Codec: "H.264", Group: "DEMAND",
+		}},
+		{"Movie.Title.2019.2160p.UHD.BluRay.REMUX.HDR10+.DV.TrueHD.7.1.Atmos-FGT", MediaInfo{
+			Title: "Movie Title", Year: 2019, Resolution: "2160p", Source: "BluRay", Audio: "TrueHD 7.1 Atmos", HDR: []string{"HDR10+", "DV"}, Group: "FGT",
+		}},
+		{"Movie.Name.2020.1080p.AMZN.WEB-DL.DTS-HD.MA.5.1.H.264-GRP", MediaInfo{
+			Title: "Movie Name", Year: 2020, Resolution: "1080p", Source: "WEB-DL", Codec: "H.264", Audio: "DTS-HD MA 5.1", Group: "GRP",
+		}},
+		// Years in the title are kept; the last one is the release year
+		{"2001.A.Space.Odyssey.1968.1080p.BluRay.x264", MediaInfo{
+			Title: "2001 A Space Odyssey", Year: 1968, Resolution: "1080p", Source: "BluRay", Codec: "H.264",
+		}},
+		{"Blade.Runner.2049.2017.1080p.WEB-DL", MediaInfo{Title: "Blade Runner 2049", Year: 2017, Resolution: "1080p", Source: "WEB-DL"}},
+		{"Some Movie (2010) [1080p]", MediaInfo{Title: "Some Movie", Year: 2010, Resolution: "1080p"}},
+		// "DL" after "WEB-" is not a group, and "Cam" in a title is not a source
+		{"Movie.2019.1080p.WEB-DL", MediaInfo{Title: "Movie", Year: 2019, Resolution: "1080p", Source: "WEB-DL"}},
+		{"The.Cam.Girl.2019.HDRip", MediaInfo{Title: "The Cam Girl", Year: 2019, Source: "HDRip"}},
+		{"[SubsPlease] Frieren - 05 (1080p) [ABCD1234]", MediaInfo{Title: "Frieren", Episodes: []int{5}, Resolution: "1080p", Group: "SubsPlease"}},
+		{"home video", MediaInfo{Title: "home video"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ParseRelease(tt.name); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseRelease(%q)\n got  %+v\n want %+v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMediaInfoFor(t *testing.T) {
+	const pack = "Show.Name.S01.1080p.BluRay.x264-GRP"
+	tests := []struct {
+		path string
+		want MediaInfo
+	}{
+		{"Show.Name.S01E03.mkv", MediaInfo{Title: "Show Name", Season: 1, Episodes: []int{3}, Resolution: "1080p", Source: "BluRay", Codec: "H.264", Group: "GRP"}},
+		{"Extras/01.mkv", MediaInfo{Title: "Show Name", Season: 1, Episodes: []int{1}, Resolution: "1080p", Source: "BluRay", Codec: "H.264", Group: "GRP"}},
+	}
+	for _, tt := range tests {
+		if got := mediaInfoFor(pack, tt.path); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("mediaInfoFor(%q)\n got  %+v\n want %+v", tt.path, got, tt.want)
+		}
+	}
+}
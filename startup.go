@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"log"
+	"maps"
+	"time"
+
+	"github.com/anacrolix/torrent"
+)
+
+// startupEdgeBytes is how much of each end of a video is fetched before the
+// rest of it.
+const startupEdgeBytes = 4 << 20
+
+// startupPollInterval is how often startup progress is checked.
+const startupPollInterval = 250 * time.Millisecond
+
+// streamStartup fetches the first and last few MB of the selected video
+// before anything else: players need the start of the file, and container
+// indexes such as an MP4's moov atom or MKV cues often sit at the end. Once
+// both ends are present the file is reported ready to play and the rest is
+// downloaded in order, a readahead's worth of pieces at a time, until the
+// file is complete or ctx is cancelled.
+func (m *TorrentManager) streamStartup(ctx context.Context, mt *ManagedTorrent, fileIndex int) {
+	t := mt.Torrent
+	file := t.Files()[fileIndex]
+	if file.Length() == 0 {
+		return
+	}
+
+	// The priorities set here are keyed by ctx, so a fetch being cancelled
+	// never clears those of the one replacing it
+	prios := make(map[int]torrent.PiecePriority)
+	apply := func() {
+		mt.mu.Lock()
+		mt.pieces.set(t, ctx, maps.Clone(prios))
+		mt.mu.Unlock()
+	}
+	defer func() {
+		mt.mu.Lock()
+		mt.pieces.set(t, ctx, nil)
+		mt.mu.Unlock()
+	}()
+
+	edges := edgePieces(file.Offset(), file.Length(), t.Info().PieceLength, startupEdgeBytes)
+	for _, i := range edges {
+		prios[i] = torrent.PiecePriorityNow
+	}
+	apply()
+
+	ticker := time.NewTicker(startupPollInterval)
+	defer ticker.Stop()
+	wait := func() bool {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-t.Closed():
+			return false
+		case <-ticker.C:
+			return true
+		}
+	}
+
+	for !piecesComplete(t, edges) {
+		if !wait() {
+			return
+		}
+	}
+	clear(prios)
+	apply()
+
+	mt.mu.Lock()
+	if ctx.Err() != nil || mt.SelectedFile != fileIndex {
+		mt.mu.Unlock()
+		return
+	}
+	mt.readyToPlay = true
+	mt.mu.Unlock()
+	log.Printf("Ready to play %s of %s", file.DisplayPath(), mt.ID)
+	m.events.publish(TorrentEvent{Type: EventReadyToPlay, TorrentID: mt.ID, Data: fileIndex})
+	m.probeDuration(ctx, mt, fileIndex)
+
+	// Sequential download: keep a window of High priority pieces just past
+	// the first missing one. Readers' own priorities still come first.
+	window := max(int(m.cfg.readaheadFor(file.Length())/t.Info().PieceLength), 1)
+	next := file.BeginPieceIndex()
+	for {
+		for next < file.EndPieceIndex() && t.Piece(next).State().Complete {
+			next++
+		}
+		if next == file.EndPieceIndex() {
+			return
+		}
+		if _, ok := prios[next]; !ok {
+			clear(prios)
+			for i := next; i < min(next+window, file.EndPieceIndex()); i++ {
+				prios[i] = torrent.PiecePriorityHigh
+			}
+			apply()
+		}
+		if !wait() {
+			return
+		}
+	}
+}
+
+// filePieceSpan returns the half-open range of pieces holding length bytes
+// of f starting at off.
+func filePieceSpan(f *torrent.File, off, length int64) (int, int) {
+	return pieceSpan(f.Torrent().Info().PieceLength, f.Offset()+off, length)
+}
+
+// pieceSpan returns the half-open range of pieces holding length bytes of a
+// torrent starting at off.
+func pieceSpan(pieceLength, off, length int64) (int, int) {
+	return int(off / pieceLength), int((off+length-1)/pieceLength) + 1
+}
+
+// edgePieces returns the pieces holding the first and last edge bytes of a
+// file of length bytes at offset in its torrent, in order and each once.
+func edgePieces(offset, length, pieceLength, edge int64) []int {
+	if length <= 0 {
+		return nil
+	}
+	edge = min(edge, length)
+	headStart, headEnd := pieceSpan(pieceLength, offset, edge)
+	tailStart, tailEnd := pieceSpan(pieceLength, offset+length-edge, edge)
+	var pieces []int
+	for i := headStart; i < headEnd; i++ {
+		pieces = append(pieces, i)
+	}
+	for i := max(tailStart, headEnd); i < tailEnd; i++ {
+		pieces = append(pieces, i)
+	}
+	return pieces
+}
+
+func piecesComplete(t *torrent.Torrent, pieces []int) bool {
+	for _, i := range pieces {
+		if !t.Piece(i).State().Complete {
+			return false
+		}
+	}
+	return true
+}
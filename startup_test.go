@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEdgePieces(t *testing.T) {
+	// Pieces of 10 bytes and ends of 25 bytes
+	tests := []struct {
+		name           string
+		offset, length int64
+		want           []int
+	}{
+		{"long file", 0, 200, []int{0, 1, 2, 17, 18, 19}},
+		{"ends overlap", 0, 40, []int{0, 1, 2, 3}},
+		{"ends share a piece", 0, 30, []int{0, 1, 2}},
+		{"shorter than one end", 0, 12, []int{0, 1}},
+		{"starts and ends mid-piece", 15, 100, []int{1, 2, 3, 9, 10, 11}},
+		{"one byte", 37, 1, []int{3}},
+		{"empty", 20, 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := edgePieces(tt.offset, tt.length, 10, 25); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("edgePieces() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamStartupReadyToPlay(t *testing.T) {
+	m := newTestManager(t)
+	// The first episode fills whole pieces on disk; the second never arrives
+	mt := addTestTorrent(t, m, 1<<14,
+		testFile{path: "ep1.avi", data: bytes.Repeat([]byte("ep1!"), 1<<14)},
+		testFile{path: "ep2.avi", length: 60000})
+	events, unsubscribe := m.Subscribe(mt.ID)
+	defer unsubscribe()
+
+	readyToPlay := func() bool {
+		mt.mu.Lock()
+		defer mt.mu.Unlock()
+		return mt.readyToPlay
+	}
+
+	if _, err := m.SelectFile(mt.ID, 1); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(3 * startupPollInterval)
+	if readyToPlay() {
+		t.Fatal("ready to play without the ends of the file")
+	}
+
+	if _, err := m.SelectFile(mt.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ev := <-events:
+			if ev.Type != EventReadyToPlay {
+				continue
+			}
+			if ev.Data != 0 {
+				t.Fatalf("ready to play file %v, want 0", ev.Data)
+			}
+			if !readyToPlay() {
+				t.Error("event published before the torrent was marked ready")
+			}
+			return
+		case <-timeout:
+			t.Fatal("no ready to play event")
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const storeFileName = "go-stream.db"
+
+var torrentsBucket = []byte("torrents")
+
+// storedTorrent is the persisted form of a ManagedTorrent. MetaInfo holds the
+// bencoded metainfo so the torrent can be re-added without fetching metadata.
+type storedTorrent struct {
+	MetaInfo     []byte           `json:"metainfo"`
+	SelectedFile int              `json:"selectedFile"`
+	LastAccessed time.Time        `json:"lastAccessed"`
+	Subtitles    []storedSubtitle `json:"subtitles"`
+}
+
+type storedSubtitle struct {
+	Name      string `json:"name"`
+	Index     int    `json:"index"`
+	FileIndex *int   `json:"fileIndex,omitempty"` // unset in records from before it was kept
+	Encoding  string `json:"encoding,omitempty"`
+	Language  string `json:"language,omitempty"`
+	Content   []byte `json:"content"`
+}
+
+// torrentStore keeps managed torrents in a bbolt database keyed by infohash.
+type torrentStore struct {
+	db *bolt.DB
+}
+
+func openTorrentStore(path string) (*torrentStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open store: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(torrentsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("init store: %w", err)
+	}
+	return &torrentStore{db: db}, nil
+}
+
+func (s *torrentStore) Put(id string, rec storedTorrent) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("encode torrent %s: %w", id, err)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(torrentsBucket).Put([]byte(id), data)
+	})
+}
+
+func (s *torrentStore) Delete(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(torrentsBucket).Delete([]byte(id))
+	})
+}
+
+// Clear removes every stored torrent.
+func (s *torrentStore) Clear() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(torrentsBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucket(torrentsBucket)
+		return err
+	})
+}
+
+// Load returns all stored torrents keyed by infohash. Records that fail to
+// decode are skipped and reported in the returned error.
+func (s *torrentStore) Load() (map[string]storedTorrent, error) {
+	recs := make(map[string]storedTorrent)
+	var bad []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(torrentsBucket).ForEach(func(k, v []byte) error {
+			var rec storedTorrent
+			if err := json.Unmarshal(v, &rec); err != nil {
+				bad = append(bad, string(k))
+				return nil
+			}
+			recs[string(k)] = rec
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("load store: %w", err)
+	}
+	if len(bad) > 0 {
+		return recs, fmt.Errorf("skipped undecodable torrents: %v", bad)
+	}
+	return recs, nil
+}
+
+func (s *torrentStore) Close() error {
+	return s.db.Close()
+}
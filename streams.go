@@ -0,0 +1,278 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+)
+
+// nextEpisodeAt is the fraction of a video sequential playback has to reach
+// before the next episode's first pieces are prioritised.
+const nextEpisodeAt = 0.9
+
+// nextEpisodeMinRun caps how much a reader must have read in one sequential
+// run before it counts as playback rather than a seek towards the end.
+const nextEpisodeMinRun = 16 << 20
+
+// coordinateInterval is how often stream windows follow their playheads.
+const coordinateInterval = 500 * time.Millisecond
+
+// staleReaderAfter is how long a reader other than the playhead may go
+// without reading before it stops fetching ahead. Browsers leave requests
+// for abandoned positions open for a while after the user scrubs.
+const staleReaderAfter = 3 * time.Second
+
+// streamReader releases its file's stream slot on Close. It tracks its
+// position for the file's stream coordinator, and when nearEnd is set calls
+// it once, when sequential reading gets close to the end of the file.
+type streamReader struct {
+	torrent.Reader
+	release func()
+	length  int64
+
+	mu        sync.Mutex
+	nearEnd   func()
+	pos       int64
+	runStart  int64
+	started   time.Time // opened or last moved by a seek
+	lastRead  time.Time
+	readahead int64
+	stale     bool
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pos += int64(n)
+	r.lastRead = time.Now()
+	if r.stale {
+		// Being read again means someone is still watching
+		r.stale = false
+		r.Reader.SetReadahead(r.readahead)
+	}
+	if r.nearEnd != nil && r.pos >= int64(float64(r.length)*nextEpisodeAt) &&
+		r.pos-r.runStart >= min(nextEpisodeMinRun, r.length/20) {
+		go r.nearEnd()
+		r.nearEnd = nil
+	}
+	return n, err
+}
+
+func (r *streamReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.Reader.Seek(offset, whence)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err == nil && pos != r.pos {
+		r.pos, r.runStart = pos, pos
+		r.started = time.Now()
+	}
+	return pos, err
+}
+
+func (r *streamReader) Close() error {
+	err := r.Reader.Close()
+	r.release()
+	return err
+}
+
+// setReadahead changes how far the reader fetches ahead, taking effect
+// once it is no longer stale.
+func (r *streamReader) setReadahead(readahead int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if readahead == r.readahead {
+		return
+	}
+	r.readahead = readahead
+	if !r.stale {
+		r.Reader.SetReadahead(readahead)
+	}
+}
+
+// setStale stops or resumes fetching ahead of the reader.
+func (r *streamReader) setStale(stale bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if stale == r.stale {
+		return
+	}
+	r.stale = stale
+	if stale {
+		r.Reader.SetReadahead(0)
+	} else {
+		r.Reader.SetReadahead(r.readahead)
+	}
+}
+
+// fileStreams coordinates the readers open on one file. The most recently
+// opened or moved reader is taken as the playhead: pieces ahead of it get a
+// window of priorities that fall with distance, and other readers left idle
+// stop fetching ahead.
+type fileStreams struct {
+	readers map[*streamReader]struct{}
+	status  StreamStatus
+}
+
+// StreamStatus describes the readers open on a file and the window of
+// pieces being fetched ahead of the playhead.
+type StreamStatus struct {
+	FileIndex    int        `json:"fileIndex"`
+	Readers      int        `json:"readers"`
+	StaleReaders int        `json:"staleReaders"`
+	Position     int64      `json:"position"`
+	Readahead    int64      `json:"readahead"`
+	Window       pieceRange `json:"window"`
+}
+
+// coordinate picks the playhead, marks idle readers stale and moves the
+// priority window. Callers must hold mt.mu.
+func (fs *fileStreams) coordinate(mt *ManagedTorrent, fileIndex int, now time.Time, readahead int64) {
+	var playhead *streamReader
+	var playheadStarted time.Time
+	for r := range fs.readers {
+		r.mu.Lock()
+		started := r.started
+		r.mu.Unlock()
+		if playhead == nil || started.After(playheadStarted) {
+			playhead, playheadStarted = r, started
+		}
+	}
+
+	fs.status = StreamStatus{FileIndex: fileIndex, Readers: len(fs.readers), Readahead: readahead}
+	for r := range fs.readers {
+		r.setReadahead(readahead)
+		r.mu.Lock()
+		idle := now.Sub(r.lastRead)
+		if r.lastRead.IsZero() {
+			idle = now.Sub(r.started)
+		}
+		r.mu.Unlock()
+		stale := r != playhead && idle > staleReaderAfter
+		r.setStale(stale)
+		if stale {
+			fs.status.StaleReaders++
+		}
+	}
+	if playhead == nil {
+		return
+	}
+
+	playhead.mu.Lock()
+	pos := playhead.pos
+	playhead.mu.Unlock()
+	fs.status.Position = pos
+
+	file := mt.Torrent.Files()[fileIndex]
+	if pos >= file.Length() || readahead <= 0 {
+		mt.pieces.set(mt.Torrent, fs, nil)
+		return
+	}
+	start, end := filePieceSpan(file, pos, min(readahead, file.Length()-pos))
+	fs.status.Window = pieceRange{Start: start, End: end}
+
+	// Like deadlines: the first quarter of the window is needed now, the
+	// next quarter next, and the rest soon
+	prios := make(map[int]torrent.PiecePriority, end-start)
+	for i := start; i < end; i++ {
+		switch n := end - start; {
+		case i-start < max(n/4, 1):
+			prios[i] = torrent.PiecePriorityNow
+		case i-start < n/2:
+			prios[i] = torrent.PiecePriorityNext
+		default:
+			prios[i] = torrent.PiecePriorityHigh
+		}
+	}
+	mt.pieces.set(mt.Torrent, fs, prios)
+}
+
+// coordinateStreams moves every file's stream window along with its playhead,
+// and resizes readahead as the download rate changes, until the manager is
+// closed.
+func (m *TorrentManager) coordinateStreams() {
+	ticker := time.NewTicker(coordinateInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.closed:
+			return
+		case now := <-ticker.C:
+			for _, mt := range m.List() {
+				mt.mu.Lock()
+				for i, fs := range mt.streams {
+					fs.coordinate(mt, i, now, m.readahead(mt, i))
+				}
+				mt.mu.Unlock()
+			}
+		}
+	}
+}
+
+// piecePriorities layers the piece priorities wanted by several owners, such
+// as the startup fetch, the next episode and stream windows, so one owner
+// lowering a piece doesn't undo another's. A piece gets the highest priority
+// any owner gives it, on top of its file's priority. Owners are compared by
+// identity.
+type piecePriorities struct {
+	owners map[any]map[int]torrent.PiecePriority
+}
+
+// set replaces owner's piece priorities, nil dropping them, and applies the
+// pieces that changed to t. Callers must hold the owning torrent's mu.
+func (pp *piecePriorities) set(t *torrent.Torrent, owner any, prios map[int]torrent.PiecePriority) {
+	for i, prio := range pp.replace(owner, prios) {
+		t.Piece(i).SetPriority(prio)
+	}
+}
+
+// replace records owner's piece priorities and returns the combined priority
+// of each piece that owner gave or stopped giving a different one.
+func (pp *piecePriorities) replace(owner any, prios map[int]torrent.PiecePriority) map[int]torrent.PiecePriority {
+	if pp.owners == nil {
+		pp.owners = make(map[any]map[int]torrent.PiecePriority)
+	}
+	old := pp.owners[owner]
+	if len(prios) == 0 {
+		delete(pp.owners, owner)
+	} else {
+		pp.owners[owner] = prios
+	}
+
+	changed := make(map[int]torrent.PiecePriority)
+	combine := func(i int) {
+		var prio torrent.PiecePriority
+		for _, o := range pp.owners {
+			prio = max(prio, o[i])
+		}
+		changed[i] = prio
+	}
+	for i, p := range old {
+		if q, ok := prios[i]; !ok || q != p {
+			combine(i)
+		}
+	}
+	for i, p := range prios {
+		if q, ok := old[i]; !ok || q != p {
+			combine(i)
+		}
+	}
+	return changed
+}
+
+// streamStatuses reports the files being streamed. Callers must hold mt.mu.
+func (mt *ManagedTorrent) streamStatuses() []StreamStatus {
+	statuses := make([]StreamStatus, 0, len(mt.streams))
+	for _, fs := range mt.streams {
+		statuses = append(statuses, fs.status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].FileIndex < statuses[j].FileIndex
+	})
+	return statuses
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent"
+)
+
+func TestPiecePrioritiesReplace(t *testing.T) {
+	const (
+		none   = torrent.PiecePriorityNone
+		normal = torrent.PiecePriorityNormal
+		high   = torrent.PiecePriorityHigh
+		next   = torrent.PiecePriorityNext
+		now    = torrent.PiecePriorityNow
+	)
+	type step struct {
+		owner string
+		prios map[int]torrent.PiecePriority
+	}
+	tests := []struct {
+		name  string
+		steps []step
+		want  []torrent.PiecePriority // pieces 0-4
+	}{
+		{
+			name:  "one owner",
+			steps: []step{{"startup", map[int]torrent.PiecePriority{0: now, 4: now}}},
+			want:  []torrent.PiecePriority{now, none, none, none, now},
+		},
+		{
+			name: "overlapping owners keep the highest",
+			steps: []step{
+				{"startup", map[int]torrent.PiecePriority{0: now, 1: now}},
+				{"stream", map[int]torrent.PiecePriority{1: high, 2: next, 3: high}},
+			},
+			want: []torrent.PiecePriority{now, now, next, high, none},
+		},
+		{
+			name: "lowering a piece keeps another owner's higher one",
+			steps: []step{
+				{"startup", map[int]torrent.PiecePriority{1: now}},
+				{"stream", map[int]torrent.PiecePriority{1: now, 2: now}},
+				{"stream", map[int]torrent.PiecePriority{1: high, 2: high}},
+			},
+			want: []torrent.PiecePriority{none, now, high, none, none},
+		},
+		{
+			name: "dropping an owner falls back to the rest",
+			steps: []step{
+				{"startup", map[int]torrent.PiecePriority{0: now, 1: now}},
+				{"stream", map[int]torrent.PiecePriority{1: high, 2: high}},
+				{"startup", nil},
+			},
+			want: []torrent.PiecePriority{none, high, high, none, none},
+		},
+		{
+			name: "moving a window clears the pieces left behind",
+			steps: []step{
+				{"next episode", map[int]torrent.PiecePriority{3: normal}},
+				{"stream", map[int]torrent.PiecePriority{0: now, 1: next}},
+				{"stream", map[int]torrent.PiecePriority{2: now, 3: next}},
+			},
+			want: []torrent.PiecePriority{none, none, now, next, none},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Applying only the reported changes has to give the right
+			// priority for every piece
+			var pp piecePriorities
+			got := make([]torrent.PiecePriority, len(tt.want))
+			for _, s := range tt.steps {
+				for i, prio := range pp.replace(s.owner, s.prios) {
+					got[i] = prio
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("priorities = %v, want %v", got, tt.want)
+			}
+			last := tt.steps[len(tt.steps)-1]
+			if changed := pp.replace(last.owner, last.prios); len(changed) != 0 {
+				t.Errorf("repeating the last step changed %v", changed)
+			}
+		})
+	}
+}
+
+func TestFileStreamsCoordinate(t *testing.T) {
+	const pieceLength = 1 << 14
+	m := newTestManager(t)
+	// The second file starts partway through piece 3
+	mt := addTestTorrent(t, m, pieceLength, testFile{path: "sample.mkv", length: 50000}, testFile{path: "movie.mkv", length: 200000})
+	file := mt.Torrent.Files()[1]
+
+	now := time.Now()
+	newReader := func(pos int64, started, lastRead time.Time) *streamReader {
+		r := &streamReader{Reader: file.NewReader(), length: file.Length(), pos: pos, started: started, lastRead: lastRead}
+		t.Cleanup(func() { r.Reader.Close() })
+		return r
+	}
+	// An abandoned request from before a seek, and the playhead after it
+	abandoned := newReader(0, now.Add(-time.Minute), now.Add(-10*time.Second))
+	playhead := newReader(20000, now.Add(-time.Second), now)
+	fs := &fileStreams{readers: map[*streamReader]struct{}{abandoned: {}, playhead: {}}}
+
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	fs.coordinate(mt, 1, now, 100000)
+
+	// Bytes 70000-169999 of the torrent are pieces 4-10: one quarter Now,
+	// up to half Next and the rest High
+	want := map[int]torrent.PiecePriority{
+		4: torrent.PiecePriorityNow,
+		5: torrent.PiecePriorityNext, 6: torrent.PiecePriorityNext,
+		7: torrent.PiecePriorityHigh, 8: torrent.PiecePriorityHigh, 9: torrent.PiecePriorityHigh, 10: torrent.PiecePriorityHigh,
+	}
+	if got := mt.pieces.owners[fs]; !reflect.DeepEqual(got, want) {
+		t.Errorf("window priorities = %v, want %v", got, want)
+	}
+	wantStatus := StreamStatus{FileIndex: 1, Readers: 2, StaleReaders: 1, Position: 20000, Readahead: 100000, Window: pieceRange{Start: 4, End: 11}}
+	if fs.status != wantStatus {
+		t.Errorf("status = %+v, want %+v", fs.status, wantStatus)
+	}
+	if !abandoned.stale || playhead.stale {
+		t.Errorf("stale: abandoned %v, playhead %v; want only the abandoned reader", abandoned.stale, playhead.stale)
+	}
+
+	// Reading again revives the abandoned reader, but the playhead stays
+	abandoned.lastRead = now
+	fs.coordinate(mt, 1, now, 100000)
+	if fs.status.StaleReaders != 0 || fs.status.Position != 20000 {
+		t.Errorf("after the reader woke up, status = %+v", fs.status)
+	}
+
+	// The window is dropped once the playhead reaches the end
+	playhead.pos = file.Length()
+	fs.coordinate(mt, 1, now, 100000)
+	if _, ok := mt.pieces.owners[fs]; ok {
+		t.Error("window kept at the end of the file")
+	}
+}
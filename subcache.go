@@ -0,0 +1,334 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// subtitleCacheDir is where downloaded subtitles are kept, inside the data
+// directory.
+const subtitleCacheDir = "subtitle-cache"
+
+// SubtitleCache sits in front of subtitle providers. Search results are kept
+// in memory for a TTL; downloaded files are kept on disk, up to a total size,
+// so fetching the same subtitle for another torrent costs no quota.
+type SubtitleCache struct {
+	dir       string
+	searchTTL time.Duration
+	maxSize   int64
+
+	mu       sync.Mutex
+	searches map[string]cachedSearch
+}
+
+type cachedSearch struct {
+	provider string
+	query    SubtitleQuery
+	results  []SubSearchResult
+	expires  time.Time
+}
+
+// SubtitleCacheStats describes the cache contents.
+type SubtitleCacheStats struct {
+	Searches      []CachedSearchInfo   `json:"searches"`
+	Downloads     []CachedDownloadInfo `json:"downloads"`
+	DownloadBytes int64                `json:"downloadBytes"`
+	MaxSize       int64                `json:"maxSize"`
+}
+
+type CachedSearchInfo struct {
+	Provider  string    `json:"provider"`
+	Query     string    `json:"query"`
+	Lang      string    `json:"lang"`
+	MovieHash string    `json:"movieHash,omitempty"`
+	Season    int       `json:"season,omitempty"`
+	Episode   int       `json:"episode,omitempty"`
+	Results   int       `json:"results"`
+	Expires   time.Time `json:"expires"`
+}
+
+type CachedDownloadInfo struct {
+	Provider string    `json:"provider"`
+	ID       string    `json:"id"`
+	FileName string    `json:"fileName"`
+	Size     int64     `json:"size"`
+	LastUsed time.Time `json:"lastUsed"`
+
+	dir string
+}
+
+func NewSubtitleCache(dir string, cfg SubtitleCacheConfig) (*SubtitleCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create subtitle cache: %w", err)
+	}
+	return &SubtitleCache{
+		dir:       dir,
+		searchTTL: time.Duration(cfg.SearchTTL),
+		maxSize:   int64(cfg.MaxSize),
+		searches:  make(map[string]cachedSearch),
+	}, nil
+}
+
+// Wrap returns p with its searches and downloads going through the cache.
+func (c *SubtitleCache) Wrap(p SubtitleProvider) SubtitleProvider {
+	return &cachedProvider{SubtitleProvider: p, cache: c}
+}
+
+// Stats lists what is cached. Expired searches are left out.
+func (c *SubtitleCache) Stats() (SubtitleCacheStats, error) {
+	stats := SubtitleCacheStats{
+		Searches:  []CachedSearchInfo{},
+		Downloads: []CachedDownloadInfo{},
+		MaxSize:   c.maxSize,
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for _, s := range c.searches {
+		if now.After(s.expires) {
+			continue
+		}
+		stats.Searches = append(stats.Searches, CachedSearchInfo{
+			Provider:  s.provider,
+			Query:     s.query.Text,
+			Lang:      s.query.Lang,
+			MovieHash: s.query.MovieHash,
+			Season:    s.query.Season,
+			Episode:   s.query.Episode,
+			Results:   len(s.results),
+			Expires:   s.expires,
+		})
+	}
+	sort.Slice(stats.Searches, func(i, j int) bool {
+		return stats.Searches[i].Expires.After(stats.Searches[j].Expires)
+	})
+
+	downloads, err := c.downloads()
+	if err != nil {
+		return stats, err
+	}
+	for _, d := range downloads {
+		stats.DownloadBytes += d.Size
+	}
+	stats.Downloads = append(stats.Downloads, downloads...)
+	return stats, nil
+}
+
+// Purge empties the cache.
+func (c *SubtitleCache) Purge() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.searches = make(map[string]cachedSearch)
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return fmt.Errorf("read subtitle cache: %w", err)
+	}
+	for _, e := range entries {
+		if err := os.RemoveAll(filepath.Join(c.dir, e.Name())); err != nil {
+			return fmt.Errorf("purge subtitle cache: %w", err)
+		}
+	}
+	return nil
+}
+
+func (c *SubtitleCache) search(p SubtitleProvider, q SubtitleQuery) ([]SubSearchResult, error) {
+	if c.searchTTL <= 0 {
+		return p.Search(q)
+	}
+
+	key := fmt.Sprintf("%s\x00%#v", p.Name(), q)
+	now := time.Now()
+	c.mu.Lock()
+	s, ok := c.searches[key]
+	c.mu.Unlock()
+	if ok && now.Before(s.expires) {
+		return append([]SubSearchResult(nil), s.results...), nil
+	}
+
+	results, err := p.Search(q)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	for k, s := range c.searches {
+		if now.After(s.expires) {
+			delete(c.searches, k)
+		}
+	}
+	c.searches[key] = cachedSearch{
+		provider: p.Name(),
+		query:    q,
+		results:  append([]SubSearchResult(nil), results...),
+		expires:  now.Add(c.searchTTL),
+	}
+	c.mu.Unlock()
+	return results, nil
+}
+
+func (c *SubtitleCache) download(p SubtitleProvider, id string) ([]byte, string, error) {
+	if c.maxSize <= 0 {
+		return p.Download(id)
+	}
+
+	dir := filepath.Join(c.dir, cacheDirName(p.Name()), cacheDirName(id))
+	if content, name, ok := c.load(dir); ok {
+		return content, name, nil
+	}
+
+	content, name, err := p.Download(id)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := c.store(dir, name, content); err != nil {
+		log.Printf("subtitle cache: %v", err)
+	}
+	return content, name, nil
+}
+
+// load reads the file cached in dir and marks it as recently used.
+func (c *SubtitleCache) load(dir string) ([]byte, string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 1 {
+		return nil, "", false
+	}
+	path := filepath.Join(dir, entries[0].Name())
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", false
+	}
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return content, entries[0].Name(), true
+}
+
+// store writes content to dir, then evicts the least recently used files
+// until the cache fits in maxSize.
+func (c *SubtitleCache) store(dir, name string, content []byte) error {
+	if int64(len(content)) > c.maxSize {
+		return nil
+	}
+	name = filepath.Base(name)
+	if name == "." || name == string(filepath.Separator) {
+		name = "subtitle"
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, name), content, 0o644); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+
+	downloads, err := c.downloads()
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, d := range downloads {
+		total += d.Size
+	}
+	// downloads is sorted most recently used first
+	for i := len(downloads) - 1; i >= 0 && total > c.maxSize; i-- {
+		if err := os.RemoveAll(downloads[i].dir); err != nil {
+			return err
+		}
+		total -= downloads[i].Size
+	}
+	return nil
+}
+
+// downloads lists the cached files, most recently used first. c.mu must be
+// held.
+func (c *SubtitleCache) downloads() ([]CachedDownloadInfo, error) {
+	var downloads []CachedDownloadInfo
+	providers, err := os.ReadDir(c.dir)
+	if err != nil {
+		return nil, fmt.Errorf("read subtitle cache: %w", err)
+	}
+	for _, pe := range providers {
+		provider, err := url.PathUnescape(pe.Name())
+		if !pe.IsDir() || err != nil {
+			continue
+		}
+		ids, err := os.ReadDir(filepath.Join(c.dir, pe.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("read subtitle cache: %w", err)
+		}
+		for _, ie := range ids {
+			id, err := url.PathUnescape(ie.Name())
+			if !ie.IsDir() || err != nil {
+				continue
+			}
+			dir := filepath.Join(c.dir, pe.Name(), ie.Name())
+			files, err := os.ReadDir(dir)
+			if err != nil || len(files) != 1 {
+				continue
+			}
+			info, err := files[0].Info()
+			if err != nil {
+				continue
+			}
+			downloads = append(downloads, CachedDownloadInfo{
+				Provider: provider,
+				ID:       id,
+				FileName: files[0].Name(),
+				Size:     info.Size(),
+				LastUsed: info.ModTime(),
+				dir:      dir,
+			})
+		}
+	}
+	sort.Slice(downloads, func(i, j int) bool {
+		return downloads[i].LastUsed.After(downloads[j].LastUsed)
+	})
+	return downloads, nil
+}
+
+// cacheDirName escapes s for use as a single directory name. Dots are
+// escaped too, so "." and ".." can't name a directory outside the cache.
+func cacheDirName(s string) string {
+	return strings.ReplaceAll(url.PathEscape(s), ".", "%2E")
+}
+
+// cachedProvider is a SubtitleProvider whose calls go through a cache.
+type cachedProvider struct {
+	SubtitleProvider
+	cache *SubtitleCache
+}
+
+func (p *cachedProvider) Search(q SubtitleQuery) ([]SubSearchResult, error) {
+	return p.cache.search(p.SubtitleProvider, q)
+}
+
+func (p *cachedProvider) Download(id string) ([]byte, string, error) {
+	return p.cache.download(p.SubtitleProvider, id)
+}
+
+// Quota passes through the wrapped provider's quota, if it reports one.
+func (p *cachedProvider) Quota() (SubtitleQuota, bool) {
+	if qr, ok := p.SubtitleProvider.(SubtitleQuotaReporter); ok {
+		return qr.Quota()
+	}
+	return SubtitleQuota{}, false
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingProvider serves a subtitle of size bytes for any ID and counts the
+// calls that reach it.
+type countingProvider struct {
+	mu        sync.Mutex
+	searches  int
+	downloads int
+	size      int
+}
+
+func (p *countingProvider) Name() string { return "counting" }
+
+func (p *countingProvider) Search(q SubtitleQuery) ([]SubSearchResult, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.searches++
+	return []SubSearchResult{{ID: q.Text, Release: q.Text}}, nil
+}
+
+func (p *countingProvider) Download(id string) ([]byte, string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.downloads++
+	return []byte(strings.Repeat("x", p.size)), id + ".srt", nil
+}
+
+func TestSubtitleCacheSearch(t *testing.T) {
+	cache, err := NewSubtitleCache(t.TempDir(), SubtitleCacheConfig{SearchTTL: Duration(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner := &countingProvider{}
+	p := cache.Wrap(inner)
+
+	q := SubtitleQuery{Text: "movie", Lang: "en"}
+	for range 3 {
+		if results, err := p.Search(q); err != nil || len(results) != 1 {
+			t.Fatalf("Search() = %v, %v", results, err)
+		}
+	}
+	p.Search(SubtitleQuery{Text: "movie", Lang: "en", MovieHash: "0123456789abcdef"})
+	p.Search(SubtitleQuery{Text: "movie", Lang: "de"})
+	if inner.searches != 3 {
+		t.Errorf("provider searched %d times, want 3", inner.searches)
+	}
+
+	stats, err := cache.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Searches) != 3 {
+		t.Errorf("Stats() lists %d searches, want 3", len(stats.Searches))
+	}
+
+	// Expired entries are searched again
+	cache.mu.Lock()
+	for k, s := range cache.searches {
+		s.expires = time.Now().Add(-time.Second)
+		cache.searches[k] = s
+	}
+	cache.mu.Unlock()
+	p.Search(q)
+	if inner.searches != 4 {
+		t.Errorf("provider searched %d times after expiry, want 4", inner.searches)
+	}
+}
+
+func TestSubtitleCacheDownload(t *testing.T) {
+	cache, err := NewSubtitleCache(t.TempDir(), SubtitleCacheConfig{MaxSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner := &countingProvider{size: 40}
+	p := cache.Wrap(inner)
+
+	download := func(id string) {
+		t.Helper()
+		content, name, err := p.Download(id)
+		if err != nil || len(content) != 40 || name != id+".srt" {
+			t.Fatalf("Download(%q) = %d bytes, %q, %v", id, len(content), name, err)
+		}
+		time.Sleep(10 * time.Millisecond) // keep modification times apart
+	}
+
+	download("a")
+	download("a")
+	if inner.downloads != 1 {
+		t.Fatalf("provider downloaded %d times, want 1", inner.downloads)
+	}
+
+	// b is now the least recently used, so it goes when c doesn't fit
+	download("b")
+	download("a")
+	download("c")
+
+	stats, err := cache.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, d := range stats.Downloads {
+		ids = append(ids, d.ID)
+	}
+	if got := strings.Join(ids, ","); got != "c,a" {
+		t.Errorf("cached downloads = %s, want c,a", got)
+	}
+	if stats.DownloadBytes != 80 {
+		t.Errorf("DownloadBytes = %d, want 80", stats.DownloadBytes)
+	}
+
+	// IDs are escaped rather than used as paths
+	download("../../escape")
+	if stats, _ := cache.Stats(); stats.Downloads[0].ID != "../../escape" {
+		t.Errorf("most recent download = %+v", stats.Downloads[0])
+	}
+
+	if err := cache.Purge(); err != nil {
+		t.Fatal(err)
+	}
+	if stats, _ := cache.Stats(); len(stats.Downloads) != 0 || stats.DownloadBytes != 0 {
+		t.Errorf("Stats() after Purge = %+v", stats)
+	}
+	calls := inner.downloads
+	download("a")
+	if inner.downloads != calls+1 {
+		t.Error("download after Purge was served from the cache")
+	}
+}
@@ -3,51 +3,634 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"fmt"
+	"math"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 )
 
-// ConvertSRTtoVTT converts SRT subtitle content to WebVTT format.
+// ConvertSRTtoVTT converts SRT subtitle content to WebVTT format. Cues with
+// malformed timing are dropped; use ParseSRT to see why.
 func ConvertSRTtoVTT(srt []byte) []byte {
-	// Strip BOM
-	srt = bytes.TrimPrefix(srt, []byte("\xEF\xBB\xBF"))
+	track, _ := ParseSRT(srt)
+	return track.VTT()
+}
+
+func isDigitsOnly(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// subtitleToVTT converts subtitle content to WebVTT based on the extension
+// of name. fps is passed to ConvertSUBtoVTT for .sub files. Content in an
+// unrecognised format is returned unchanged.
+func subtitleToVTT(name string, content []byte, fps float64) []byte {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".srt":
+		return ConvertSRTtoVTT(content)
+	case ".ass", ".ssa":
+		return ConvertASStoVTT(content)
+	case ".sub":
+		return ConvertSUBtoVTT(content, fps)
+	default:
+		return content
+	}
+}
+
+type assStyle struct {
+	bold      bool
+	italic    bool
+	underline bool
+	align     int // numpad layout, 2 is bottom centre
+}
 
-	var buf bytes.Buffer
-	buf.WriteString("WEBVTT\n\n")
+// assDefaultEventFormat is used when the [Events] section has no Format line.
+var assDefaultEventFormat = []string{"layer", "start", "end", "style", "name", "marginl", "marginr", "marginv", "effect", "text"}
 
-	scanner := bufio.NewScanner(bytes.NewReader(srt))
-	afterBlank := true
+// ConvertASStoVTT converts ASS/SSA subtitle content to WebVTT format. Bold,
+// italic and underline from styles and override tags become VTT tags,
+// alignment becomes cue settings, and drawings are dropped.
+func ConvertASStoVTT(ass []byte) []byte {
+	ass = bytes.TrimPrefix(ass, []byte("\xEF\xBB\xBF"))
 
+	var (
+		section      string
+		styleFormat  []string
+		eventFormat  = assDefaultEventFormat
+		legacyStyles bool
+		styles       = map[string]assStyle{}
+		cues         []Cue
+	)
+
+	scanner := bufio.NewScanner(bytes.NewReader(ass))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
 	for scanner.Scan() {
-		line := scanner.Text()
-		trimmed := strings.TrimSpace(line)
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(line)
+			legacyStyles = section == "[v4 styles]"
+			continue
+		}
 
-		// Skip numeric index lines (digits only after a blank line)
-		if afterBlank && isDigitsOnly(trimmed) {
-			afterBlank = false
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
 			continue
 		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
 
-		// Replace comma with dot in timestamp lines
-		if strings.Contains(line, "-->") {
-			line = strings.ReplaceAll(line, ",", ".")
+		switch {
+		case strings.HasSuffix(section, "styles]") && key == "format":
+			styleFormat = splitASSFormat(value)
+		case strings.HasSuffix(section, "styles]") && key == "style":
+			name, style := parseASSStyle(styleFormat, value, legacyStyles)
+			styles[name] = style
+		case section == "[events]" && key == "format":
+			eventFormat = splitASSFormat(value)
+		case section == "[events]" && key == "dialogue":
+			if cue, ok := parseASSDialogue(eventFormat, value, styles); ok {
+				cues = append(cues, cue)
+			}
 		}
+	}
 
-		afterBlank = trimmed == ""
-		buf.WriteString(line)
-		buf.WriteByte('\n')
+	return (&Track{Cues: cues}).VTT()
+}
+
+func splitASSFormat(value string) []string {
+	fields := strings.Split(value, ",")
+	for i, f := range fields {
+		fields[i] = strings.ToLower(strings.TrimSpace(f))
 	}
+	return fields
+}
 
-	return buf.Bytes()
+func parseASSStyle(format []string, value string, legacy bool) (string, assStyle) {
+	style := assStyle{align: 2}
+	var name string
+	for i, v := range strings.Split(value, ",") {
+		if i >= len(format) {
+			break
+		}
+		v = strings.TrimSpace(v)
+		switch format[i] {
+		case "name":
+			name = v
+		case "bold":
+			style.bold = v != "0" && v != ""
+		case "italic":
+			style.italic = v != "0" && v != ""
+		case "underline":
+			style.underline = v != "0" && v != ""
+		case "alignment":
+			if n, err := strconv.Atoi(v); err == nil {
+				if legacy {
+					n = legacyASSAlignment(n)
+				}
+				if n >= 1 && n <= 9 {
+					style.align = n
+				}
+			}
+		}
+	}
+	return name, style
 }
 
-func isDigitsOnly(s string) bool {
+func parseASSDialogue(format []string, value string, styles map[string]assStyle) (Cue, bool) {
+	fields := strings.SplitN(value, ",", len(format))
+	if len(fields) != len(format) {
+		return Cue{}, false
+	}
+
+	var (
+		cue       Cue
+		text      string
+		styleName string
+		startOK   bool
+		endOK     bool
+	)
+	for i, name := range format {
+		switch name {
+		case "start":
+			cue.Start, startOK = parseASSTime(fields[i])
+		case "end":
+			cue.End, endOK = parseASSTime(fields[i])
+		case "style":
+			styleName = strings.TrimSpace(fields[i])
+		case "text":
+			text = fields[i]
+		}
+	}
+	if !startOK || !endOK || cue.End < cue.Start {
+		return Cue{}, false
+	}
+
+	style, ok := styles[styleName]
+	if !ok {
+		// Style names are matched case-insensitively and a leading
+		// asterisk (as in "*Default") is ignored by renderers.
+		for name, s := range styles {
+			if strings.EqualFold(strings.TrimPrefix(name, "*"), strings.TrimPrefix(styleName, "*")) {
+				style, ok = s, true
+				break
+			}
+		}
+		if !ok {
+			style = assStyle{align: 2}
+		}
+	}
+
+	var align int
+	cue.Text, align = renderASSText(text, style)
+	if cue.Text == "" {
+		return Cue{}, false
+	}
+	cue.Settings = vttAlignmentSettings(align)
+	return cue, true
+}
+
+// parseASSTime parses an H:MM:SS.cc timestamp into milliseconds.
+func parseASSTime(s string) (int, bool) {
+	parts := strings.Split(strings.TrimSpace(s), ":")
+	if len(parts) != 3 {
+		return 0, false
+	}
+	h, err1 := strconv.Atoi(parts[0])
+	m, err2 := strconv.Atoi(parts[1])
+	secs, err3 := strconv.ParseFloat(parts[2], 64)
+	if err1 != nil || err2 != nil || err3 != nil || h < 0 || m < 0 || secs < 0 {
+		return 0, false
+	}
+	return (h*3600+m*60)*1000 + int(secs*1000+0.5), true
+}
+
+// formatVTTTime formats milliseconds as HH:MM:SS.mmm.
+func formatVTTTime(ms int) string {
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// legacyASSAlignment maps SSA \a values to the numpad layout used by \an.
+func legacyASSAlignment(a int) int {
+	switch a {
+	case 1, 2, 3:
+		return a
+	case 5, 6, 7:
+		return a + 2
+	case 9, 10, 11:
+		return a - 5
+	default:
+		return 0
+	}
+}
+
+// vttAlignmentSettings maps a numpad alignment to VTT cue settings. Bottom
+// centre is the VTT default and needs none.
+func vttAlignmentSettings(align int) string {
+	var settings []string
+	switch align {
+	case 7, 8, 9:
+		settings = append(settings, "line:0")
+	case 4, 5, 6:
+		settings = append(settings, "line:50%")
+	}
+	switch align {
+	case 1, 4, 7:
+		settings = append(settings, "position:10%", "align:start")
+	case 3, 6, 9:
+		settings = append(settings, "position:90%", "align:end")
+	}
+	return strings.Join(settings, " ")
+}
+
+// assTextWriter emits cue text, opening and closing VTT tags lazily so that
+// formatting only wraps visible text and tags are always properly nested.
+type assTextWriter struct {
+	buf        strings.Builder
+	want, open assStyle
+	openTags   []string
+}
+
+func (w *assTextWriter) syncTags() {
+	if w.want.bold == w.open.bold && w.want.italic == w.open.italic && w.want.underline == w.open.underline {
+		return
+	}
+	for i := len(w.openTags) - 1; i >= 0; i-- {
+		w.buf.WriteString("</" + w.openTags[i] + ">")
+	}
+	w.openTags = w.openTags[:0]
+	for _, t := range []struct {
+		on  bool
+		tag string
+	}{{w.want.bold, "b"}, {w.want.italic, "i"}, {w.want.underline, "u"}} {
+		if t.on {
+			w.buf.WriteString("<" + t.tag + ">")
+			w.openTags = append(w.openTags, t.tag)
+		}
+	}
+	w.open = w.want
+}
+
+func (w *assTextWriter) text(s string) {
 	if s == "" {
-		return false
+		return
+	}
+	if strings.TrimSpace(s) != "" {
+		w.syncTags()
+	}
+	w.buf.WriteString(s)
+}
+
+// String returns the cue text with trailing breaks removed and open tags
+// closed.
+func (w *assTextWriter) String() string {
+	var b strings.Builder
+	b.WriteString(strings.TrimRight(w.buf.String(), " \n"))
+	for i := len(w.openTags) - 1; i >= 0; i-- {
+		b.WriteString("</" + w.openTags[i] + ">")
+	}
+	return b.String()
+}
+
+// renderASSText converts an ASS dialogue text field to VTT cue text and
+// returns the alignment in effect.
+func renderASSText(text string, style assStyle) (string, int) {
+	w := &assTextWriter{want: style}
+	align := style.align
+	drawing := false
+
+	for len(text) > 0 {
+		if text[0] == '{' {
+			if end := strings.IndexByte(text, '}'); end >= 0 {
+				applyASSOverrides(text[1:end], style, &w.want, &align, &drawing)
+				text = text[end+1:]
+				continue
+			}
+		}
+
+		next := strings.IndexByte(text[1:], '{') + 1
+		if next == 0 {
+			next = len(text)
+		}
+		chunk := text[:next]
+		text = text[next:]
+		if drawing {
+			continue
+		}
+
+		chunk = strings.NewReplacer(`\N`, "\n", `\n`, " ", `\h`, "\u00a0").Replace(chunk)
+		chunk = escapeVTTText(chunk)
+		lines := strings.Split(chunk, "\n")
+		for i, l := range lines {
+			if i > 0 {
+				w.buf.WriteByte('\n')
+			}
+			w.text(l)
+		}
 	}
+
+	// Blank lines would end the cue early in VTT
+	var out []string
+	for _, l := range strings.Split(w.String(), "\n") {
+		if l = strings.TrimSpace(l); l != "" {
+			out = append(out, l)
+		}
+	}
+	result := strings.Join(out, "\n")
+	if stripVTTTags(result) == "" {
+		return "", align
+	}
+	return result, align
+}
+
+// applyASSOverrides interprets the tags of one {...} override block.
+func applyASSOverrides(block string, style assStyle, want *assStyle, align *int, drawing *bool) {
+	for _, tag := range strings.Split(block, `\`) {
+		tag = strings.TrimSpace(tag)
+		switch {
+		case tag == "":
+		case tag[0] == 'r':
+			want.bold, want.italic, want.underline = style.bold, style.italic, style.underline
+		case strings.HasPrefix(tag, "an"):
+			if n, err := strconv.Atoi(tag[2:]); err == nil && n >= 1 && n <= 9 {
+				*align = n
+			}
+		case tag[0] == 'a' && isDigitsOnly(tag[1:]):
+			n, _ := strconv.Atoi(tag[1:])
+			if n = legacyASSAlignment(n); n != 0 {
+				*align = n
+			}
+		case tag[0] == 'p' && isDigitsOnly(tag[1:]):
+			*drawing = tag[1:] != "0"
+		case tag[0] == 'i' && isDigitsOnly(tag[1:]):
+			want.italic = tag[1:] != "0"
+		case tag[0] == 'u' && isDigitsOnly(tag[1:]):
+			want.underline = tag[1:] != "0"
+		case tag[0] == 'b' && isDigitsOnly(tag[1:]):
+			// \b1 or a font weight such as \b700
+			n, _ := strconv.Atoi(tag[1:])
+			want.bold = n == 1 || n >= 500
+		case tag == "i" || tag == "b" || tag == "u":
+			// A bare tag resets to the style's value
+			switch tag {
+			case "i":
+				want.italic = style.italic
+			case "b":
+				want.bold = style.bold
+			case "u":
+				want.underline = style.underline
+			}
+		}
+	}
+}
+
+func stripVTTTags(s string) string {
+	var b strings.Builder
+	inTag := false
 	for _, r := range s {
-		if r < '0' || r > '9' {
-			return false
+		switch {
+		case r == '<':
+			inTag = true
+		case r == '>':
+			inTag = false
+		case !inTag:
+			b.WriteRune(r)
 		}
 	}
-	return true
+	return strings.TrimSpace(b.String())
+}
+
+// defaultMicroDVDFPS is assumed for MicroDVD files without a frame rate
+// header when the caller doesn't supply one.
+const defaultMicroDVDFPS = 23.976
+
+var (
+	microDVDLine    = regexp.MustCompile(`^\{(\d+)\}\{(\d*)\}(.*)$`)
+	microDVDCode    = regexp.MustCompile(`\{[a-zA-Z]:[^}]*\}`)
+	subViewerTiming = regexp.MustCompile(`^(\d{1,2}):(\d{2}):(\d{2})\.(\d{2}),(\d{1,2}):(\d{2}):(\d{2})\.(\d{2})$`)
+	subViewerCue    = regexp.MustCompile(`(?m)^\s*\d{1,2}:\d{2}:\d{2}\.\d{2},\d{1,2}:\d{2}:\d{2}\.\d{2}\s*$`)
+	subViewerBreak  = regexp.MustCompile(`(?i)\[br\]`)
+)
+
+// ConvertSUBtoVTT converts a text-based .sub file to WebVTT, detecting
+// whether it is MicroDVD or SubViewer 2.0. fps is used for MicroDVD files
+// that lack a frame rate header; 0 selects 23.976. Unrecognised content,
+// such as image-based VobSub, yields an empty track.
+func ConvertSUBtoVTT(sub []byte, fps float64) []byte {
+	sub = bytes.TrimPrefix(sub, []byte("\xEF\xBB\xBF"))
+
+	scanner := bufio.NewScanner(bytes.NewReader(sub))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if microDVDLine.MatchString(line) {
+			return ConvertMicroDVDtoVTT(sub, fps)
+		}
+		break
+	}
+	if subViewerCue.Match(sub) {
+		return ConvertSubViewerToVTT(sub)
+	}
+	return (&Track{}).VTT()
+}
+
+// ConvertMicroDVDtoVTT converts frame-based MicroDVD subtitles
+// ({start}{end}text) to WebVTT. A leading {1}{1}23.976 line sets the frame
+// rate; otherwise fps is used, or 23.976 if fps is 0. "|" separates lines and
+// {y:i}, {y:b} and {y:u} (or a leading "/") style a line; uppercase {Y:...}
+// on the first line styles the whole cue.
+func ConvertMicroDVDtoVTT(sub []byte, fps float64) []byte {
+	sub = bytes.TrimPrefix(sub, []byte("\xEF\xBB\xBF"))
+	if fps <= 0 {
+		fps = defaultMicroDVDFPS
+	}
+
+	var cues []Cue
+	first := true
+	scanner := bufio.NewScanner(bytes.NewReader(sub))
+	for scanner.Scan() {
+		m := microDVDLine.FindStringSubmatch(strings.TrimSpace(scanner.Text()))
+		if m == nil {
+			continue
+		}
+		startFrame, _ := strconv.Atoi(m[1])
+		endFrame, endErr := strconv.Atoi(m[2])
+
+		if first {
+			first = false
+			// Frame rate header: {1}{1}23.976
+			if startFrame <= 1 && endFrame <= 1 {
+				if v, err := strconv.ParseFloat(strings.TrimSpace(m[3]), 64); err == nil && v > 0 && v < 200 {
+					fps = v
+					continue
+				}
+			}
+		}
+
+		start := int(float64(startFrame)*1000/fps + 0.5)
+		end := start + 3000
+		if endErr == nil {
+			end = int(float64(endFrame)*1000/fps + 0.5)
+		}
+		if end < start {
+			continue
+		}
+
+		if text := renderMicroDVDText(m[3]); text != "" {
+			cues = append(cues, Cue{Start: start, End: end, Text: text})
+		}
+	}
+
+	return (&Track{Cues: cues}).VTT()
+}
+
+func renderMicroDVDText(text string) string {
+	var cueStyle assStyle
+	var out []string
+	for i, line := range strings.Split(text, "|") {
+		style := cueStyle
+		// Control codes at the start of a line, e.g. {y:i}{c:$0000ff}
+		for strings.HasPrefix(line, "{") {
+			end := strings.IndexByte(line, '}')
+			if end < 0 || !microDVDCode.MatchString(line[:end+1]) {
+				break
+			}
+			code := line[1:end]
+			if code[0] == 'y' || code[0] == 'Y' {
+				s := strings.ToLower(code[2:])
+				style.italic = style.italic || strings.Contains(s, "i")
+				style.bold = style.bold || strings.Contains(s, "b")
+				style.underline = style.underline || strings.Contains(s, "u")
+				if code[0] == 'Y' && i == 0 {
+					cueStyle = style
+				}
+			}
+			line = line[end+1:]
+		}
+		if strings.HasPrefix(line, "/") {
+			style.italic = true
+			line = line[1:]
+		}
+
+		line = microDVDCode.ReplaceAllString(line, "")
+		line = strings.TrimSpace(escapeVTTText(line))
+		if line == "" {
+			continue
+		}
+		out = append(out, wrapVTTStyle(line, style))
+	}
+	return strings.Join(out, "\n")
+}
+
+// ConvertSubViewerToVTT converts SubViewer 2.0 subtitles, whose cues are a
+// "HH:MM:SS.cc,HH:MM:SS.cc" line followed by text using [br] for line
+// breaks, to WebVTT. Header tags such as [INFORMATION] are ignored.
+func ConvertSubViewerToVTT(sub []byte) []byte {
+	sub = bytes.TrimPrefix(sub, []byte("\xEF\xBB\xBF"))
+
+	var (
+		cues []Cue
+		cur  *Cue
+		text []string
+	)
+	flush := func() {
+		if cur != nil {
+			var lines []string
+			for _, l := range text {
+				for _, part := range subViewerBreak.Split(l, -1) {
+					if part = strings.TrimSpace(escapeVTTText(part)); part != "" {
+						lines = append(lines, part)
+					}
+				}
+			}
+			if len(lines) > 0 {
+				cur.Text = strings.Join(lines, "\n")
+				cues = append(cues, *cur)
+			}
+		}
+		cur, text = nil, nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(sub))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if m := subViewerTiming.FindStringSubmatch(line); m != nil {
+			flush()
+			start := subViewerTime(m[1:5])
+			end := subViewerTime(m[5:9])
+			if end >= start {
+				cur = &Cue{Start: start, End: end}
+			}
+			continue
+		}
+		if line == "" {
+			flush()
+			continue
+		}
+		if cur != nil {
+			text = append(text, line)
+		}
+	}
+	flush()
+
+	return (&Track{Cues: cues}).VTT()
+}
+
+// subViewerTime converts hour, minute, second and centisecond fields to
+// milliseconds.
+func subViewerTime(f []string) int {
+	h, _ := strconv.Atoi(f[0])
+	m, _ := strconv.Atoi(f[1])
+	sec, _ := strconv.Atoi(f[2])
+	cs, _ := strconv.Atoi(f[3])
+	return ((h*60+m)*60+sec)*1000 + cs*10
+}
+
+func escapeVTTText(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+func wrapVTTStyle(text string, style assStyle) string {
+	if style.underline {
+		text = "<u>" + text + "</u>"
+	}
+	if style.italic {
+		text = "<i>" + text + "</i>"
+	}
+	if style.bold {
+		text = "<b>" + text + "</b>"
+	}
+	return text
+}
+
+// ShiftVTT retimes every cue in WebVTT content. Each timestamp is first
+// scaled by ratio, the source fps divided by the target fps, and then moved
+// by offsetMs. Cues that would end at or before zero are dropped, and start
+// times that would become negative are clamped to zero.
+func ShiftVTT(vtt []byte, offsetMs int, ratio float64) []byte {
+	// Invalid cues are reported in the error but the rest still parse
+	track, _ := ParseVTT(vtt)
+	shift := func(ms int) int {
+		return int(math.Round(float64(ms)*ratio)) + offsetMs
+	}
+
+	cues := track.Cues[:0]
+	for _, c := range track.Cues {
+		c.Start, c.End = max(shift(c.Start), 0), shift(c.End)
+		if c.End > 0 {
+			cues = append(cues, c)
+		}
+	}
+	track.Cues = cues
+	return track.VTT()
 }
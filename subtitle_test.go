@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -76,3 +78,356 @@ Another cue
 func normalizeNewlines(s string) string {
 	return strings.ReplaceAll(s, "\r\n", "\n")
 }
+
+func TestParseSRT(t *testing.T) {
+	tests := []struct {
+		name    string
+		srt     string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "loose timestamps",
+			srt:  "1\n0:01:02,5 --> 0:01:04.25\nShort fraction\n\n2\n00:01:05:100 --> 00:01:06:000\nColon separator\n",
+			want: "WEBVTT\n\n00:01:02.500 --> 00:01:04.250\nShort fraction\n\n00:01:05.100 --> 00:01:06.000\nColon separator\n",
+		},
+		{
+			name: "bare number in cue text",
+			srt:  "1\n00:00:01,000 --> 00:00:03,000\nThe answer is\n\n42\n\n2\n00:00:04,000 --> 00:00:05,000\nNext\n",
+			want: "WEBVTT\n\n00:00:01.000 --> 00:00:03.000\nThe answer is\n42\n\n00:00:04.000 --> 00:00:05.000\nNext\n",
+		},
+		{
+			name: "overlapping and out of order cues",
+			srt:  "1\n00:00:05,000 --> 00:00:08,000\nLater\n\n2\n00:00:01,000 --> 00:00:06,000\nEarlier\n",
+			want: "WEBVTT\n\n00:00:01.000 --> 00:00:06.000\nEarlier\n\n00:00:05.000 --> 00:00:08.000\nLater\n",
+		},
+		{
+			name: "arrow in text and CR line endings",
+			srt:  "1\r00:00:01,000 --> 00:00:02,000 X1:10 X2:20\rA --&gt; B\r",
+			want: "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nA --&gt; B\n",
+		},
+		{
+			name:    "malformed timing is skipped",
+			srt:     "1\n00:00:01,000 --> 00:00:02,000\nGood\n\n2\n00:00:xx,000 --> 00:00:04,000\nBad\n\n3\n00:00:05,000 --> 00:00:04,000\nBackwards\n",
+			want:    "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nGood\n",
+			wantErr: "line 6: start time: invalid timestamp \"00:00:xx,000\"\nline 10: cue ends before it starts",
+		},
+		{
+			name:    "text before first cue",
+			srt:     "Subtitles by someone\n1\n00:00:01,000 --> 00:00:02,000\nHi\n",
+			want:    "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nHi\n",
+			wantErr: "line 1: text outside of a cue",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			track, err := ParseSRT([]byte(tt.srt))
+			if got := string(track.VTT()); got != tt.want {
+				t.Errorf("ParseSRT().VTT():\ngot:\n%q\nwant:\n%q", got, tt.want)
+			}
+			gotErr := ""
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if gotErr != tt.wantErr {
+				t.Errorf("ParseSRT() error = %q, want %q", gotErr, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseVTT(t *testing.T) {
+	tests := []struct {
+		name    string
+		vtt     string
+		want    []Cue
+		wantErr string
+	}{
+		{
+			name: "identifiers, settings and comments",
+			vtt: "WEBVTT - title\nKind: captions\n\nNOTE skip me\n\nSTYLE\n::cue { color: red }\n\n" +
+				"intro\n00:01.000 --> 00:02.500 align:start line:0\n<i>Hi</i>\nthere\n\n01:00:00.000 --> 01:00:01.000\nLate\n",
+			want: []Cue{
+				{ID: "intro", Start: 1000, End: 2500, Settings: "align:start line:0", Text: "<i>Hi</i>\nthere"},
+				{Start: 3600000, End: 3601000, Text: "Late"},
+			},
+		},
+		{
+			name:    "missing header",
+			vtt:     "00:00:01.000 --> 00:00:02.000\nNo header\n",
+			wantErr: "line 1: missing WEBVTT header",
+		},
+		{
+			name:    "bad cues are reported",
+			vtt:     "WEBVTT\n\nJust text\n\n00:00:01,000 --> 00:00:02.000\nComma\n\n00:00:03.000 --> 00:00:04.000\nOK\n",
+			want:    []Cue{{Start: 3000, End: 4000, Text: "OK"}},
+			wantErr: "line 3: expected cue timing\nline 5: start time: invalid timestamp \"00:00:01,000\"",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			track, err := ParseVTT([]byte(tt.vtt))
+			if !reflect.DeepEqual(track.Cues, tt.want) {
+				t.Errorf("ParseVTT() cues = %+v, want %+v", track.Cues, tt.want)
+			}
+			gotErr := ""
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if gotErr != tt.wantErr {
+				t.Errorf("ParseVTT() error = %q, want %q", gotErr, tt.wantErr)
+			}
+		})
+	}
+}
+
+func FuzzConvertSRTtoVTT(f *testing.F) {
+	f.Add("1\n00:00:01,000 --> 00:00:04,000\nHello world\n\n2\n00:00:05,000 --> 00:00:08,000\nSecond line\n")
+	f.Add("\xEF\xBB\xBF1\r\n0:01:02,5 --> 0:01:04,0\r\n42\r\n\r\n7\r\n")
+	f.Add("00:00:05,000 --> 00:00:01,000\n-->\n")
+
+	f.Fuzz(func(t *testing.T, srt string) {
+		srtTrack, _ := ParseSRT([]byte(srt))
+		vtt := ConvertSRTtoVTT([]byte(srt))
+
+		// The output must always be valid WebVTT holding every parsed cue
+		vttTrack, err := ParseVTT(vtt)
+		if err != nil {
+			t.Fatalf("ConvertSRTtoVTT output does not parse: %v\n%q", err, vtt)
+		}
+		if len(vttTrack.Cues) != len(srtTrack.Cues) {
+			t.Fatalf("got %d cues, want %d\n%q", len(vttTrack.Cues), len(srtTrack.Cues), vtt)
+		}
+	})
+}
+
+func FuzzParseVTT(f *testing.F) {
+	f.Add("WEBVTT\n\nid\n00:00:01.000 --> 00:00:02.000 align:start\nHello\n")
+	f.Add("WEBVTT\n\nNOTE x\n\n01:00:00.000 --> 00:59:00.000\nBackwards\n")
+
+	f.Fuzz(func(t *testing.T, vtt string) {
+		track, _ := ParseVTT([]byte(vtt))
+
+		// Writing and re-parsing a track must be lossless
+		out := track.VTT()
+		again, err := ParseVTT(out)
+		if err != nil {
+			t.Fatalf("VTT() output does not parse: %v\n%q", err, out)
+		}
+		if got := again.VTT(); !bytes.Equal(got, out) {
+			t.Fatalf("round trip changed output:\n%q\n%q", out, got)
+		}
+	})
+}
+
+func TestConvertASStoVTT(t *testing.T) {
+	const header = `[Script Info]
+ScriptType: v4.00+
+
+[V4+ Styles]
+Format: Name, Fontname, Fontsize, PrimaryColour, Bold, Italic, Underline, Alignment, MarginL, MarginR, MarginV
+Style: Default,Arial,20,&H00FFFFFF,0,0,0,2,10,10,10
+Style: Thoughts,Arial,20,&H00FFFFFF,0,-1,0,2,10,10,10
+Style: Sign,Arial,20,&H00FFFFFF,-1,0,0,8,10,10,10
+
+[Events]
+Format: Layer, Start, End, Style, Name, MarginL, MarginR, MarginV, Effect, Text
+`
+
+	tests := []struct {
+		name string
+		ass  string
+		want string
+	}{
+		{
+			name: "basic dialogue with line break",
+			ass:  header + "Dialogue: 0,0:00:01.00,0:00:04.50,Default,,0,0,0,,Hello\\Nworld\n",
+			want: "WEBVTT\n\n00:00:01.000 --> 00:00:04.500\nHello\nworld\n",
+		},
+		{
+			name: "text containing commas",
+			ass:  header + "Dialogue: 0,0:00:01.00,0:00:02.00,Default,,0,0,0,,Well, yes, no\n",
+			want: "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nWell, yes, no\n",
+		},
+		{
+			name: "italic override tags",
+			ass:  header + "Dialogue: 0,0:00:01.00,0:00:02.00,Default,,0,0,0,,{\\i1}Whisper{\\i0} loud\n",
+			want: "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\n<i>Whisper</i> loud\n",
+		},
+		{
+			name: "unclosed italic is closed at end of cue",
+			ass:  header + "Dialogue: 0,0:00:01.00,0:00:02.00,Default,,0,0,0,,{\\i1}Line one\\N\n",
+			want: "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\n<i>Line one</i>\n",
+		},
+		{
+			name: "italic style and reset",
+			ass:  header + "Dialogue: 0,0:00:01.00,0:00:02.00,Thoughts,,0,0,0,,Maybe {\\i0}not{\\r} again\n",
+			want: "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\n<i>Maybe </i>not<i> again</i>\n",
+		},
+		{
+			name: "top alignment from override and style",
+			ass: header +
+				"Dialogue: 0,0:00:01.00,0:00:02.00,Default,,0,0,0,,{\\an8}Top\n" +
+				"Dialogue: 0,0:00:03.00,0:00:04.00,Sign,,0,0,0,,Sign text\n",
+			want: "WEBVTT\n\n00:00:01.000 --> 00:00:02.000 line:0\nTop\n\n00:00:03.000 --> 00:00:04.000 line:0\n<b>Sign text</b>\n",
+		},
+		{
+			name: "left alignment and stripped positioning tags",
+			ass:  header + "Dialogue: 0,0:00:01.00,0:00:02.00,Default,,0,0,0,,{\\an1\\pos(10,400)\\fad(200,200)}Left\n",
+			want: "WEBVTT\n\n00:00:01.000 --> 00:00:02.000 position:10% align:start\nLeft\n",
+		},
+		{
+			name: "drawing commands dropped",
+			ass: header +
+				"Dialogue: 0,0:00:01.00,0:00:02.00,Default,,0,0,0,,{\\p1}m 0 0 l 100 0 100 100 0 100{\\p0}\n" +
+				"Dialogue: 0,0:00:02.00,0:00:03.00,Default,,0,0,0,,Kept{\\p1}m 0 0 l 5 5{\\p0} text\n",
+			want: "WEBVTT\n\n00:00:02.000 --> 00:00:03.000\nKept text\n",
+		},
+		{
+			name: "comments ignored and cues sorted by start",
+			ass: header +
+				"Dialogue: 0,0:00:05.00,0:00:06.00,Default,,0,0,0,,Second\n" +
+				"Comment: 0,0:00:01.00,0:00:02.00,Default,,0,0,0,,Note\n" +
+				"Dialogue: 0,0:00:03.00,0:00:04.00,Default,,0,0,0,,First\n",
+			want: "WEBVTT\n\n00:00:03.000 --> 00:00:04.000\nFirst\n\n00:00:05.000 --> 00:00:06.000\nSecond\n",
+		},
+		{
+			name: "custom format order and html escaping",
+			ass:  "[Events]\nFormat: Start, End, Text\nDialogue: 1:02:03.45,1:02:04.00,a < b & c\n",
+			want: "WEBVTT\n\n01:02:03.450 --> 01:02:04.000\na &lt; b &amp; c\n",
+		},
+		{
+			name: "legacy SSA alignment",
+			ass: "[V4 Styles]\nFormat: Name, Alignment\nStyle: Default,6\n\n[Events]\n" +
+				"Format: Marked, Start, End, Style, Name, MarginL, MarginR, MarginV, Effect, Text\n" +
+				"Dialogue: Marked=0,0:00:01.00,0:00:02.00,Default,,0,0,0,,Top\n",
+			want: "WEBVTT\n\n00:00:01.000 --> 00:00:02.000 line:0\nTop\n",
+		},
+		{
+			name: "empty input",
+			ass:  "",
+			want: "WEBVTT\n\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := string(ConvertASStoVTT([]byte(tt.ass)))
+			if got != tt.want {
+				t.Errorf("ConvertASStoVTT():\ngot:\n%q\nwant:\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConvertSUBtoVTT(t *testing.T) {
+	tests := []struct {
+		name string
+		sub  string
+		fps  float64
+		want string
+	}{
+		{
+			name: "MicroDVD with frame rate header",
+			sub:  "{1}{1}25\n{25}{100}Hello|world\n",
+			want: "WEBVTT\n\n00:00:01.000 --> 00:00:04.000\nHello\nworld\n",
+		},
+		{
+			name: "MicroDVD with caller fps",
+			sub:  "{24}{48}One second\n",
+			fps:  24,
+			want: "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nOne second\n",
+		},
+		{
+			name: "MicroDVD header wins over caller fps",
+			sub:  "{1}{1}25.000\r\n{50}{75}Two seconds\r\n",
+			fps:  24,
+			want: "WEBVTT\n\n00:00:02.000 --> 00:00:03.000\nTwo seconds\n",
+		},
+		{
+			name: "MicroDVD default fps",
+			sub:  "{1025}{1100}Text\n",
+			want: "WEBVTT\n\n00:00:42.751 --> 00:00:45.879\nText\n",
+		},
+		{
+			name: "MicroDVD per-line and whole-cue styles",
+			sub:  "{1}{1}25\n{25}{50}{y:i}Italic|Plain|/Slash\n{50}{75}{Y:b}{c:$0000ff}Bold|Also bold\n",
+			want: "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\n<i>Italic</i>\nPlain\n<i>Slash</i>\n\n" +
+				"00:00:02.000 --> 00:00:03.000\n<b>Bold</b>\n<b>Also bold</b>\n",
+		},
+		{
+			name: "SubViewer 2.0",
+			sub: "[INFORMATION]\n[TITLE]Movie\n[END INFORMATION]\n[SUBTITLE]\n[COLF]&HFFFFFF,[STYLE]bd,[SIZE]18,[FONT]Arial\n" +
+				"00:00:01.00,00:00:04.50\nFirst line[br]Second line\n\n" +
+				"00:01:02.30,00:01:05.00\nA < B\n",
+			want: "WEBVTT\n\n00:00:01.000 --> 00:00:04.500\nFirst line\nSecond line\n\n" +
+				"00:01:02.300 --> 00:01:05.000\nA &lt; B\n",
+		},
+		{
+			name: "image-based sub yields empty track",
+			sub:  "\x00\x00\x01\xba\x44\x00\x04\x00",
+			want: "WEBVTT\n\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := string(ConvertSUBtoVTT([]byte(tt.sub), tt.fps))
+			if got != tt.want {
+				t.Errorf("ConvertSUBtoVTT():\ngot:\n%q\nwant:\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShiftVTT(t *testing.T) {
+	const vtt = "WEBVTT\n\n00:00:01.000 --> 00:00:04.500 align:start line:90%\nHello --\n\n01:00:00.000 --> 01:00:02.000\nLater\n"
+
+	tests := []struct {
+		name     string
+		offsetMs int
+		ratio    float64
+		want     string
+	}{
+		{
+			name:     "positive offset",
+			offsetMs: 1500,
+			ratio:    1,
+			want:     "WEBVTT\n\n00:00:02.500 --> 00:00:06.000 align:start line:90%\nHello --\n\n01:00:01.500 --> 01:00:03.500\nLater\n",
+		},
+		{
+			name:     "negative offset clamps at zero",
+			offsetMs: -2000,
+			ratio:    1,
+			want:     "WEBVTT\n\n00:00:00.000 --> 00:00:02.500 align:start line:90%\nHello --\n\n00:59:58.000 --> 01:00:00.000\nLater\n",
+		},
+		{
+			name:     "cues ending before zero are dropped",
+			offsetMs: -4500,
+			ratio:    1,
+			want:     "WEBVTT\n\n00:59:55.500 --> 00:59:57.500\nLater\n",
+		},
+		{
+			name:  "PAL to film framerate",
+			ratio: 25 / 23.976,
+			want:  "WEBVTT\n\n00:00:01.043 --> 00:00:04.692 align:start line:90%\nHello --\n\n01:02:33.754 --> 01:02:35.839\nLater\n",
+		},
+		{
+			name:     "ratio applies before offset",
+			offsetMs: 1000,
+			ratio:    2,
+			want:     "WEBVTT\n\n00:00:03.000 --> 00:00:10.000 align:start line:90%\nHello --\n\n02:00:01.000 --> 02:00:05.000\nLater\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := string(ShiftVTT([]byte(vtt), tt.offsetMs, tt.ratio))
+			if got != tt.want {
+				t.Errorf("ShiftVTT():\ngot:\n%q\nwant:\n%q", got, tt.want)
+			}
+		})
+	}
+}
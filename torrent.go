@@ -1,22 +1,29 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
 	"github.com/anacrolix/torrent/storage"
 )
 
 var (
 	videoExtensions    = map[string]bool{".mkv": true, ".mp4": true, ".avi": true, ".webm": true, ".mov": true, ".m4v": true}
-	subtitleExtensions = map[string]bool{".srt": true, ".vtt": true, ".ass": true, ".sub": true}
+	subtitleExtensions = map[string]bool{".srt": true, ".vtt": true, ".ass": true, ".ssa": true, ".sub": true}
+	matroskaExtensions = map[string]bool{".mkv": true, ".mk3d": true, ".webm": true}
 	imageExtensions    = map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".bmp": true, ".svg": true}
 )
 
@@ -27,108 +34,369 @@ type FileInfo struct {
 	IsVideo    bool   `json:"isVideo"`
 	IsSubtitle bool   `json:"isSubtitle"`
 	IsImage    bool   `json:"isImage"`
+
+	Media    *MediaInfo `json:"media,omitempty"`    // parsed from the release name, videos only
+	Duration float64    `json:"duration,omitempty"` // seconds, read from the container once selected
 }
 
+// SubtitleInfo is a subtitle attached to a torrent. Subtitle files in the
+// torrent use their file index and are offered with every video; the rest
+// belong to one video and get negative indexes that are never reused.
 type SubtitleInfo struct {
-	Name    string `json:"name"`
-	Index   int    `json:"index"`
-	Content []byte `json:"-"`
+	Name      string `json:"name"`
+	Index     int    `json:"index"`
+	FileIndex int    `json:"fileIndex"`          // the video it belongs to, -1 for subtitle files
+	Encoding  string `json:"encoding,omitempty"` // source character encoding
+	Language  string `json:"language,omitempty"` // set for embedded tracks
+	Content   []byte `json:"-"`
 }
 
+// Torrent lifecycle states reported by the status API.
+const (
+	StateFetchingMetadata = "fetching_metadata"
+	StateReady            = "ready"
+	StateFailed           = "failed"
+)
+
 type ManagedTorrent struct {
 	mu           sync.Mutex
 	Torrent      *torrent.Torrent
 	ID           string
 	Name         string
+	State        string
+	Error        string
 	Files        []FileInfo
 	SelectedFile int
 	Subtitles    []SubtitleInfo
 	LastAccessed time.Time
+
+	// subtitleSeq counts the subtitles ever attached with negative indexes,
+	// so a removed one's index is never handed to another.
+	subtitleSeq int
+
+	// streams holds the open readers per file index so piece priorities
+	// follow every file being watched, not just SelectedFile.
+	streams map[int]*fileStreams
+	pieces  piecePriorities
+	rate    transferRate
+
+	// cancelEmbedded stops extracting subtitles from the previously
+	// selected file.
+	cancelEmbedded context.CancelFunc
+	// cancelStartup stops fetching the previously selected video's ends
+	// first and the rest in order; readyToPlay reports both ends are
+	// present.
+	cancelStartup context.CancelFunc
+	readyToPlay   bool
+
+	// preparedNext is the episode whose first pieces were prioritised ahead
+	// of autoplay, or -1.
+	preparedNext int
+
+	// loadingSidecars is set while the torrent's subtitle files are read.
+	loadingSidecars bool
+
+	// removed is set when the torrent stops being managed, after which no
+	// new stream may open on it.
+	removed bool
+}
+
+// transferRate holds throughput derived from successive samples of the
+// torrent's cumulative data counters.
+type transferRate struct {
+	sampledAt time.Time
+	read      int64
+	written   int64
+	Down      float64 // bytes per second
+	Up        float64 // bytes per second
 }
 
+const rateSampleInterval = 2 * time.Second
+
 type TorrentManager struct {
 	mu       sync.RWMutex
 	client   *torrent.Client
 	torrents map[string]*ManagedTorrent
-	dataDir  string
+	cfg      TorrentManagerConfig
+	store    *torrentStore
+	events   eventHub
+	closed   chan struct{}
 }
 
-func NewTorrentManager(dataDir string) (*TorrentManager, error) {
-	cfg := torrent.NewDefaultClientConfig()
-	cfg.Seed = false
-	cfg.ListenPort = 0
-	cfg.DefaultStorage = storage.NewFileByInfoHash(dataDir)
+// NewTorrentManager creates a manager from a validated configuration.
+func NewTorrentManager(cfg TorrentManagerConfig) (*TorrentManager, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	clientCfg := torrent.NewDefaultClientConfig()
+	clientCfg.Seed = cfg.Seed
+	clientCfg.ListenPort = cfg.ListenPort
+	clientCfg.DefaultStorage = storage.NewFileByInfoHash(cfg.DataDir)
 
-	client, err := torrent.NewClient(cfg)
+	if err := os.MkdirAll(cfg.DataDir, 0o755); err != nil {
+		return nil, fmt.Errorf("create data dir: %w", err)
+	}
+	store, err := openTorrentStore(filepath.Join(cfg.DataDir, storeFileName))
 	if err != nil {
+		return nil, err
+	}
+
+	client, err := torrent.NewClient(clientCfg)
+	if err != nil {
+		store.Close()
 		return nil, fmt.Errorf("create torrent client: %w", err)
 	}
 
-	return &TorrentManager{
+	m := &TorrentManager{
 		client:   client,
 		torrents: make(map[string]*ManagedTorrent),
-		dataDir:  dataDir,
-	}, nil
+		cfg:      cfg,
+		store:    store,
+		closed:   make(chan struct{}),
+	}
+	m.restore()
+	go m.sampleRates()
+	go m.coordinateStreams()
+	return m, nil
 }
 
-func (m *TorrentManager) AddMagnet(ctx context.Context, uri string) (*ManagedTorrent, error) {
-	t, err := m.client.AddMagnet(uri)
+// restore re-adds torrents persisted by a previous run. Their metainfo is
+// stored, so no metadata exchange with peers is needed.
+func (m *TorrentManager) restore() {
+	recs, err := m.store.Load()
 	if err != nil {
-		return nil, fmt.Errorf("add magnet: %w", err)
+		log.Printf("restore torrents: %v", err)
 	}
 
-	id := t.InfoHash().HexString()
+	for id, rec := range recs {
+		mi, err := metainfo.Load(bytes.NewReader(rec.MetaInfo))
+		if err == nil && mi.HashInfoBytes().HexString() != id {
+			err = fmt.Errorf("infohash mismatch")
+		}
+		if err != nil {
+			log.Printf("restore torrent %s: %v", id, err)
+			m.store.Delete(id)
+			continue
+		}
 
-	// Return existing if already managed
-	m.mu.RLock()
-	if mt, ok := m.torrents[id]; ok {
-		m.mu.RUnlock()
+		t, err := m.client.AddTorrent(mi)
+		if err != nil {
+			log.Printf("restore torrent %s: %v", id, err)
+			m.store.Delete(id)
+			continue
+		}
+
+		files := classifyFiles(t)
+		selected := rec.SelectedFile
+		if selected >= len(files) {
+			selected = -1
+		}
+		subs := make([]SubtitleInfo, 0, len(rec.Subtitles))
+		seq := 0
+		for _, s := range rec.Subtitles {
+			fileIndex := -1
+			switch {
+			case s.FileIndex != nil:
+				fileIndex = *s.FileIndex
+			case s.Index < 0:
+				// Stored before subtitles were kept per video, when they
+				// all belonged to the selected one
+				fileIndex = selected
+			}
+			subs = append(subs, SubtitleInfo{Name: s.Name, Index: s.Index, FileIndex: fileIndex, Encoding: s.Encoding, Language: s.Language, Content: s.Content})
+			seq = max(seq, -s.Index)
+		}
+
+		mt := &ManagedTorrent{
+			Torrent:      t,
+			ID:           id,
+			Name:         t.Name(),
+			State:        StateReady,
+			Files:        files,
+			SelectedFile: selected,
+			Subtitles:    subs,
+			LastAccessed: rec.LastAccessed,
+			subtitleSeq:  seq,
+			streams:      make(map[int]*fileStreams),
+			preparedNext: -1,
+		}
 		mt.mu.Lock()
-		mt.LastAccessed = time.Now()
+		mt.applyPriorities()
+		mt.mu.Unlock()
+
+		m.mu.Lock()
+		m.torrents[id] = mt
+		m.mu.Unlock()
+	}
+
+	if len(recs) > 0 {
+		log.Printf("Restored %d torrent(s)", len(m.torrents))
+	}
+}
+
+// persist writes the torrent's metainfo and state to the store. Torrents still
+// waiting for metadata and ones that have been removed are skipped. Callers
+// must not hold mt.mu or m.mu.
+func (m *TorrentManager) persist(mt *ManagedTorrent) {
+	mt.mu.Lock()
+	if mt.State != StateReady {
 		mt.mu.Unlock()
-		return mt, nil
+		return
+	}
+	rec := storedTorrent{
+		SelectedFile: mt.SelectedFile,
+		LastAccessed: mt.LastAccessed,
+		Subtitles:    make([]storedSubtitle, 0, len(mt.Subtitles)),
+	}
+	for _, s := range mt.Subtitles {
+		rec.Subtitles = append(rec.Subtitles, storedSubtitle{Name: s.Name, Index: s.Index, FileIndex: &s.FileIndex, Encoding: s.Encoding, Language: s.Language, Content: s.Content})
+	}
+	mt.mu.Unlock()
+
+	var buf bytes.Buffer
+	mi := mt.Torrent.Metainfo()
+	if err := mi.Write(&buf); err != nil {
+		log.Printf("persist torrent %s: %v", mt.ID, err)
+		return
+	}
+	rec.MetaInfo = buf.Bytes()
+
+	// Removal takes m.mu to forget the torrent before deleting its record,
+	// so holding it across the Put keeps a removed torrent from being
+	// written back
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.torrents[mt.ID] != mt {
+		return
+	}
+	if err := m.store.Put(mt.ID, rec); err != nil {
+		log.Printf("persist torrent %s: %v", mt.ID, err)
+	}
+}
+
+func (m *TorrentManager) persistAll() {
+	m.mu.RLock()
+	all := make([]*ManagedTorrent, 0, len(m.torrents))
+	for _, mt := range m.torrents {
+		all = append(all, mt)
 	}
 	m.mu.RUnlock()
 
-	// Wait for metadata with timeout
-	timeoutCtx, cancel := context.WithTimeout(ctx, 60*time.Second)
-	defer cancel()
+	for _, mt := range all {
+		m.persist(mt)
+	}
+}
 
-	select {
-	case <-t.GotInfo():
-	case <-timeoutCtx.Done():
-		t.Drop()
-		return nil, fmt.Errorf("metadata timeout: %w", timeoutCtx.Err())
+// AddMagnet adds a magnet link. The returned torrent may still be fetching
+// metadata; its State reports when it becomes ready or fails.
+func (m *TorrentManager) AddMagnet(uri string) (*ManagedTorrent, error) {
+	spec, err := torrent.TorrentSpecFromMagnetUri(uri)
+	if err != nil {
+		return nil, fmt.Errorf("add magnet: %w", err)
+	}
+	return m.AddTorrentSpec(spec)
+}
+
+// AddTorrentFile adds a torrent from the contents of a .torrent file.
+func (m *TorrentManager) AddTorrentFile(r io.Reader) (*ManagedTorrent, error) {
+	mi, err := metainfo.Load(r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid torrent file: %w", err)
+	}
+	spec, err := torrent.TorrentSpecFromMetaInfoErr(mi)
+	if err != nil {
+		return nil, fmt.Errorf("invalid torrent file: %w", err)
 	}
+	return m.AddTorrentSpec(spec)
+}
 
-	files := classifyFiles(t)
+// AddTorrentSpec adds a torrent without blocking. If the spec already carries
+// the info dictionary the torrent is ready immediately, otherwise metadata is
+// fetched in the background.
+func (m *TorrentManager) AddTorrentSpec(spec *torrent.TorrentSpec) (*ManagedTorrent, error) {
+	// Held across the client add so disk quota eviction never sees data
+	// for a torrent that is about to become managed as orphaned
+	m.mu.Lock()
+	t, _, err := m.client.AddTorrentSpec(spec)
+	if err != nil {
+		m.mu.Unlock()
+		return nil, fmt.Errorf("add torrent: %w", err)
+	}
+
+	id := t.InfoHash().HexString()
 
+	// Return existing if already managed, unless a previous attempt failed
+	if mt, ok := m.torrents[id]; ok {
+		mt.mu.Lock()
+		retry := mt.State == StateFailed
+		mt.LastAccessed = time.Now()
+		mt.mu.Unlock()
+		if !retry {
+			m.mu.Unlock()
+			return mt, nil
+		}
+	}
 	mt := &ManagedTorrent{
 		Torrent:      t,
 		ID:           id,
 		Name:         t.Name(),
-		Files:        files,
+		State:        StateFetchingMetadata,
 		SelectedFile: -1,
 		LastAccessed: time.Now(),
-	}
-
-	m.mu.Lock()
-	// Double-check after acquiring write lock
-	if existing, ok := m.torrents[id]; ok {
-		m.mu.Unlock()
-		t.Drop()
-		return existing, nil
+		streams:      make(map[int]*fileStreams),
+		preparedNext: -1,
 	}
 	m.torrents[id] = mt
 	m.mu.Unlock()
 
+	if t.Info() != nil {
+		m.markReady(mt)
+	} else {
+		go m.awaitInfo(mt)
+	}
 	return mt, nil
 }
 
+// awaitInfo waits for the torrent's metadata, recording a failure if no peer
+// provides it in time.
+func (m *TorrentManager) awaitInfo(mt *ManagedTorrent) {
+	timer := time.NewTimer(time.Duration(m.cfg.MetadataTimeout))
+	defer timer.Stop()
+
+	select {
+	case <-mt.Torrent.GotInfo():
+		m.markReady(mt)
+	case <-timer.C:
+		mt.Torrent.Drop()
+		mt.mu.Lock()
+		mt.State = StateFailed
+		mt.Error = "metadata timeout — no peers found"
+		mt.mu.Unlock()
+		m.events.publish(TorrentEvent{Type: EventMetadataFailed, TorrentID: mt.ID, Data: mt.Error})
+	case <-mt.Torrent.Closed():
+	case <-m.closed:
+	}
+}
+
+func (m *TorrentManager) markReady(mt *ManagedTorrent) {
+	files := classifyFiles(mt.Torrent)
+
+	mt.mu.Lock()
+	mt.Name = mt.Torrent.Name()
+	mt.Files = files
+	mt.State = StateReady
+	mt.applyPriorities()
+	mt.mu.Unlock()
+
+	m.persist(mt)
+	m.events.publish(TorrentEvent{Type: EventMetadataReceived, TorrentID: mt.ID})
+}
+
+// GetTorrent looks up a torrent and marks it as used, which holds off its
+// cleanup and eviction.
 func (m *TorrentManager) GetTorrent(id string) (*ManagedTorrent, bool) {
-	m.mu.RLock()
-	mt, ok := m.torrents[id]
-	m.mu.RUnlock()
+	mt, ok := m.peek(id)
 	if ok {
 		mt.mu.Lock()
 		mt.LastAccessed = time.Now()
@@ -137,6 +405,36 @@ func (m *TorrentManager) GetTorrent(id string) (*ManagedTorrent, bool) {
 	return mt, ok
 }
 
+// peek looks up a torrent without marking it as used, for status reads that
+// shouldn't keep a torrent alive.
+func (m *TorrentManager) peek(id string) (*ManagedTorrent, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	mt, ok := m.torrents[id]
+	return mt, ok
+}
+
+// List returns all managed torrents, most recently accessed first.
+func (m *TorrentManager) List() []*ManagedTorrent {
+	m.mu.RLock()
+	all := make([]*ManagedTorrent, 0, len(m.torrents))
+	for _, mt := range m.torrents {
+		all = append(all, mt)
+	}
+	m.mu.RUnlock()
+
+	lastAccessed := make(map[*ManagedTorrent]time.Time, len(all))
+	for _, mt := range all {
+		mt.mu.Lock()
+		lastAccessed[mt] = mt.LastAccessed
+		mt.mu.Unlock()
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return lastAccessed[all[i]].After(lastAccessed[all[j]])
+	})
+	return all
+}
+
 func (m *TorrentManager) SelectFile(id string, fileIndex int) (*ManagedTorrent, error) {
 	mt, ok := m.GetTorrent(id)
 	if !ok {
@@ -144,108 +442,515 @@ func (m *TorrentManager) SelectFile(id string, fileIndex int) (*ManagedTorrent,
 	}
 
 	mt.mu.Lock()
-	defer mt.mu.Unlock()
+	err := mt.selectFile(fileIndex)
+	if err == nil && !mt.loadingSidecars {
+		mt.loadingSidecars = true
+		go m.loadSidecarSubtitles(mt)
+	}
+	if err == nil && mt.Files[fileIndex].IsVideo {
+		ctx, cancel := context.WithCancel(context.Background())
+		mt.cancelStartup = cancel
+		go m.streamStartup(ctx, mt, fileIndex)
+	}
+	if err == nil && matroskaExtensions[strings.ToLower(filepath.Ext(mt.Files[fileIndex].Path))] {
+		ctx, cancel := context.WithCancel(context.Background())
+		mt.cancelEmbedded = cancel
+		go m.loadEmbeddedSubtitles(ctx, mt, fileIndex)
+	}
+	mt.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
 
+	m.persist(mt)
+	m.events.publish(TorrentEvent{Type: EventFileSelected, TorrentID: id, Data: fileIndex})
+	return mt, nil
+}
+
+// selectFile marks fileIndex as selected. Callers must hold mt.mu.
+func (mt *ManagedTorrent) selectFile(fileIndex int) error {
+	if mt.State != StateReady {
+		return fmt.Errorf("torrent metadata not ready")
+	}
 	if fileIndex < 0 || fileIndex >= len(mt.Files) {
-		return nil, fmt.Errorf("file index out of range")
+		return fmt.Errorf("file index out of range")
 	}
 
-	// Prioritize the selected file
-	torrentFiles := mt.Torrent.Files()
-	for _, f := range torrentFiles {
-		f.SetPriority(torrent.PiecePriorityNone)
+	if mt.cancelEmbedded != nil {
+		mt.cancelEmbedded()
+		mt.cancelEmbedded = nil
 	}
-	if mt.Files[fileIndex].IsImage {
-		torrentFiles[fileIndex].SetPriority(torrent.PiecePriorityNow)
-	} else {
-		torrentFiles[fileIndex].SetPriority(torrent.PiecePriorityNormal)
+	if mt.cancelStartup != nil {
+		mt.cancelStartup()
+		mt.cancelStartup = nil
+	}
+	mt.readyToPlay = false
+
+	// Pieces fetched ahead for autoplay are no longer wanted once something
+	// else is picked; if it was the next episode its readers take over
+	if mt.preparedNext != fileIndex {
+		mt.clearPreparedNext()
 	}
+
+	// Prioritize the selected file alongside any files still being streamed
 	mt.SelectedFile = fileIndex
+	mt.applyPriorities()
 
-	// Discover subtitles from the torrent — prefer ones matching the video name
-	mt.Subtitles = nil
+	return nil
+}
+
+// subtitlesFor lists the subtitles offered with the video at fileIndex: the
+// torrent's subtitle files, those named like the video or next to it first,
+// then the video's own. Callers must hold mt.mu.
+func (mt *ManagedTorrent) subtitlesFor(fileIndex int) []SubtitleInfo {
 	videoBase := stripExt(filepath.Base(mt.Files[fileIndex].Path))
 	videoDir := filepath.Dir(mt.Files[fileIndex].Path)
 
-	var matched, other []SubtitleInfo
+	var matched, other, own []SubtitleInfo
+	for _, s := range mt.Subtitles {
+		switch {
+		case s.Index >= 0:
+			// Match if same base name or same directory as the video
+			path := mt.Files[s.Index].Path
+			if strings.HasPrefix(stripExt(filepath.Base(path)), videoBase) || filepath.Dir(path) == videoDir {
+				matched = append(matched, s)
+			} else {
+				other = append(other, s)
+			}
+		case s.FileIndex == fileIndex:
+			own = append(own, s)
+		}
+	}
+	return append(append(matched, other...), own...)
+}
+
+// attachSubtitle gives sub the next unused negative index and attaches it.
+// Callers must hold mt.mu.
+func (mt *ManagedTorrent) attachSubtitle(sub SubtitleInfo) SubtitleInfo {
+	mt.subtitleSeq++
+	sub.Index = -mt.subtitleSeq
+	mt.Subtitles = append(mt.Subtitles, sub)
+	return sub
+}
+
+// sidecarReadTimeout bounds the wait for a subtitle file in the torrent to
+// download. Files not read in time are tried again on the next selection.
+const sidecarReadTimeout = time.Minute
+
+// loadSidecarSubtitles attaches the torrent's subtitle files that aren't
+// attached yet. Reading them waits for their pieces, so it happens outside
+// mt.mu and each file is attached as it arrives.
+func (m *TorrentManager) loadSidecarSubtitles(mt *ManagedTorrent) {
+	defer func() {
+		mt.mu.Lock()
+		mt.loadingSidecars = false
+		mt.mu.Unlock()
+	}()
+
+	mt.mu.Lock()
+	attached := make(map[int]bool)
+	for _, s := range mt.Subtitles {
+		if s.Index >= 0 {
+			attached[s.Index] = true
+		}
+	}
+	var pending []FileInfo
 	for i, fi := range mt.Files {
-		if !fi.IsSubtitle {
-			continue
+		if fi.IsSubtitle && !attached[i] {
+			pending = append(pending, fi)
 		}
-		tf := torrentFiles[i]
+	}
+	mt.mu.Unlock()
+
+	torrentFiles := mt.Torrent.Files()
+	for _, fi := range pending {
+		tf := torrentFiles[fi.Index]
 		tf.SetPriority(torrent.PiecePriorityNow)
 
-		content, err := readTorrentFile(tf)
+		ctx, cancel := context.WithTimeout(context.Background(), sidecarReadTimeout)
+		content, err := readTorrentFile(ctx, tf)
+		cancel()
 		if err != nil {
 			continue
 		}
 
-		ext := strings.ToLower(filepath.Ext(fi.Path))
-		if ext == ".srt" {
-			content = ConvertSRTtoVTT(content)
+		content, enc := decodeSubtitle(content)
+		sub := SubtitleInfo{
+			Name:      filepath.Base(fi.Path),
+			Index:     fi.Index,
+			FileIndex: -1,
+			Encoding:  enc,
+			Content:   subtitleToVTT(fi.Path, content, 0),
 		}
+		mt.mu.Lock()
+		if mt.removed {
+			mt.mu.Unlock()
+			return
+		}
+		mt.Subtitles = append(mt.Subtitles, sub)
+		mt.mu.Unlock()
 
-		sub := SubtitleInfo{
-			Name:    filepath.Base(fi.Path),
-			Index:   i,
-			Content: content,
+		m.persist(mt)
+		m.events.publish(TorrentEvent{Type: EventSubtitleAdded, TorrentID: mt.ID, Data: sub.Name})
+	}
+}
+
+// embeddedRescanInterval is how often a partly downloaded Matroska video is
+// checked for completion, when it has subtitle tracks the cues don't index.
+const embeddedRescanInterval = 5 * time.Second
+
+// loadEmbeddedSubtitles extracts the text subtitle tracks of a Matroska
+// video and attaches them once done. The reader has no readahead so only the
+// pieces holding the metadata, cues and subtitle blocks are fetched. Tracks
+// the cues don't index would need every cluster, so on a partial file those
+// are read once it completes. Results are dropped if another file was
+// selected in the meantime.
+func (m *TorrentManager) loadEmbeddedSubtitles(ctx context.Context, mt *ManagedTorrent, fileIndex int) {
+	file := mt.Torrent.Files()[fileIndex]
+	complete := file.BytesCompleted() == file.Length()
+	subs, err := readEmbeddedSubtitles(ctx, file, complete)
+	unindexed := errors.Is(err, errMKVUnindexed)
+	if err != nil && !unindexed {
+		select {
+		case <-ctx.Done():
+		case <-mt.Torrent.Closed():
+		default:
+			log.Printf("embedded subtitles in %s: %v", file.DisplayPath(), err)
 		}
+		return
+	}
+	if !m.addEmbeddedSubtitles(ctx, mt, fileIndex, subs) || !unindexed {
+		return
+	}
 
-		// Match if same base name or same directory as the video
-		subBase := stripExt(filepath.Base(fi.Path))
-		subDir := filepath.Dir(fi.Path)
-		if strings.HasPrefix(subBase, videoBase) || subDir == videoDir {
-			matched = append(matched, sub)
-		} else {
-			other = append(other, sub)
+	ticker := time.NewTicker(embeddedRescanInterval)
+	defer ticker.Stop()
+	for file.BytesCompleted() < file.Length() {
+		select {
+		case <-ctx.Done():
+			return
+		case <-mt.Torrent.Closed():
+			return
+		case <-ticker.C:
 		}
 	}
-	mt.Subtitles = append(matched, other...)
 
-	return mt, nil
+	indexed := make(map[uint64]bool, len(subs))
+	for _, s := range subs {
+		indexed[s.Track.Number] = true
+	}
+	all, err := readEmbeddedSubtitles(ctx, file, true)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("embedded subtitles in %s: %v", file.DisplayPath(), err)
+		}
+		return
+	}
+	var rest []mkvSubtitle
+	for _, s := range all {
+		if !indexed[s.Track.Number] {
+			rest = append(rest, s)
+		}
+	}
+	m.addEmbeddedSubtitles(ctx, mt, fileIndex, rest)
+}
+
+// readEmbeddedSubtitles runs extractMKVSubtitles on file through a reader
+// that fetches only the pieces it reads.
+func readEmbeddedSubtitles(ctx context.Context, file *torrent.File, scanAll bool) ([]mkvSubtitle, error) {
+	reader := file.NewReader()
+	defer reader.Close()
+	reader.SetContext(ctx)
+	reader.SetReadahead(0)
+	reader.SetResponsive()
+	return extractMKVSubtitles(reader, file.Length(), scanAll)
+}
+
+// addEmbeddedSubtitles attaches subs to the torrent, reporting false if
+// fileIndex is no longer the selected file.
+func (m *TorrentManager) addEmbeddedSubtitles(ctx context.Context, mt *ManagedTorrent, fileIndex int, subs []mkvSubtitle) bool {
+	mt.mu.Lock()
+	if ctx.Err() != nil || mt.SelectedFile != fileIndex {
+		mt.mu.Unlock()
+		return false
+	}
+	if len(subs) == 0 {
+		mt.mu.Unlock()
+		return true
+	}
+	videoBase := stripExt(filepath.Base(mt.Files[fileIndex].Path))
+	attached := make(map[string]bool)
+	for _, s := range mt.Subtitles {
+		if s.FileIndex == fileIndex {
+			attached[s.Name] = true
+		}
+	}
+	added := make([]SubtitleInfo, 0, len(subs))
+	for _, s := range subs {
+		name := fmt.Sprintf("%s.%s.vtt", videoBase, s.Track.Language)
+		if s.Track.Name != "" {
+			name = fmt.Sprintf("%s.%s (%s).vtt", videoBase, s.Track.Language, s.Track.Name)
+		}
+		if attached[name] {
+			// Extracted when the video was selected before
+			continue
+		}
+		added = append(added, mt.attachSubtitle(SubtitleInfo{
+			Name:      name,
+			FileIndex: fileIndex,
+			Encoding:  "UTF-8",
+			Language:  s.Track.Language,
+			Content:   s.VTT,
+		}))
+	}
+	mt.mu.Unlock()
+
+	m.persist(mt)
+	for _, sub := range added {
+		m.events.publish(TorrentEvent{Type: EventSubtitleAdded, TorrentID: mt.ID, Data: sub.Name})
+	}
+	return true
 }
 
-func (m *TorrentManager) GetFileReader(id string) (torrent.Reader, *torrent.File, error) {
+// MovieHash computes the OpenSubtitles hash of the selected file. Only the
+// pieces at either end of the file are fetched; ctx bounds the wait for them.
+func (m *TorrentManager) MovieHash(ctx context.Context, id string) (string, error) {
 	mt, ok := m.GetTorrent(id)
 	if !ok {
-		return nil, nil, fmt.Errorf("torrent not found")
+		return "", fmt.Errorf("torrent not found")
 	}
 
 	mt.mu.Lock()
-	selectedIdx := mt.SelectedFile
+	fileIndex := mt.SelectedFile
 	mt.mu.Unlock()
-
-	if selectedIdx < 0 {
-		return nil, nil, fmt.Errorf("no file selected")
+	if fileIndex < 0 || mt.Torrent.Info() == nil {
+		return "", fmt.Errorf("no file selected")
 	}
 
-	file := mt.Torrent.Files()[selectedIdx]
+	file := mt.Torrent.Files()[fileIndex]
 	reader := file.NewReader()
+	defer reader.Close()
+	reader.SetContext(ctx)
+	reader.SetReadahead(0)
+	reader.SetResponsive()
+
+	return openSubHash(reader, file.Length())
+}
+
+func (m *TorrentManager) GetFileReader(id string, fileIndex int) (torrent.Reader, *torrent.File, error) {
+	mt, ok := m.GetTorrent(id)
+	if !ok {
+		return nil, nil, fmt.Errorf("torrent not found")
+	}
 
-	// Scale readahead with file size: 16MB base, up to 64MB for large files
-	readahead := int64(16 * 1024 * 1024)
-	if file.Length() > 2*1024*1024*1024 { // >2GB
-		readahead = 64 * 1024 * 1024
-	} else if file.Length() > 500*1024*1024 { // >500MB
-		readahead = 32 * 1024 * 1024
+	mt.mu.Lock()
+	if mt.removed {
+		// Removed or evicted since the lookup
+		mt.mu.Unlock()
+		return nil, nil, fmt.Errorf("torrent not found")
+	}
+	if mt.State != StateReady {
+		mt.mu.Unlock()
+		return nil, nil, fmt.Errorf("torrent metadata not ready")
+	}
+	if fileIndex < 0 || fileIndex >= len(mt.Files) {
+		mt.mu.Unlock()
+		return nil, nil, fmt.Errorf("file index out of range")
 	}
+	file := mt.Torrent.Files()[fileIndex]
+	reader := file.NewReader()
+
+	readahead := m.readahead(mt, fileIndex)
 	reader.SetReadahead(readahead)
 	reader.SetResponsive()
 
-	return reader, file, nil
+	sr := &streamReader{
+		Reader:    reader,
+		length:    file.Length(),
+		started:   time.Now(),
+		readahead: readahead,
+	}
+	sr.release = func() { mt.releaseStream(fileIndex, sr) }
+	if mt.Files[fileIndex].IsVideo {
+		sr.nearEnd = func() { m.prepareNextEpisode(mt, fileIndex) }
+	}
+
+	fs := mt.streams[fileIndex]
+	if fs == nil {
+		fs = &fileStreams{readers: make(map[*streamReader]struct{})}
+		mt.streams[fileIndex] = fs
+	}
+	fs.readers[sr] = struct{}{}
+	fs.status.FileIndex, fs.status.Readers = fileIndex, len(fs.readers)
+	mt.applyPriorities()
+	mt.mu.Unlock()
+
+	return sr, file, nil
 }
 
-func (m *TorrentManager) RemoveTorrent(id string) {
+// prepareNextEpisode raises the priority of the start and last piece of the
+// episode after fileIndex, so autoplay can start it without waiting.
+func (m *TorrentManager) prepareNextEpisode(mt *ManagedTorrent, fileIndex int) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	next, ok := nextEpisode(buildPlaylists(mt.Files), fileIndex)
+	if !ok || next == mt.preparedNext {
+		return
+	}
+	mt.clearPreparedNext()
+
+	// The last piece is included as container indexes often live there
+	f := mt.Torrent.Files()[next]
+	if f.Length() == 0 {
+		return
+	}
+	prios := map[int]torrent.PiecePriority{f.EndPieceIndex() - 1: torrent.PiecePriorityHigh}
+	headStart, headEnd := filePieceSpan(f, 0, min(max(m.cfg.readaheadFor(f.Length()), 1), f.Length()))
+	for i := headStart; i < headEnd; i++ {
+		prios[i] = torrent.PiecePriorityHigh
+	}
+	mt.pieces.set(mt.Torrent, preparedNextOwner, prios)
+	mt.preparedNext = next
+	log.Printf("Preparing next episode %s of %s", mt.Files[next].Path, mt.ID)
+}
+
+// clearPreparedNext drops the priority given to the next episode's pieces.
+// Callers must hold mt.mu.
+func (mt *ManagedTorrent) clearPreparedNext() {
+	mt.pieces.set(mt.Torrent, preparedNextOwner, nil)
+	mt.preparedNext = -1
+}
+
+// preparedNextOwner owns the piece priorities set by prepareNextEpisode.
+const preparedNextOwner = "next episode"
+
+// AddSubtitle attaches an already converted VTT subtitle to the selected
+// video. encoding records the character encoding the subtitle was decoded
+// from.
+func (m *TorrentManager) AddSubtitle(mt *ManagedTorrent, name, encoding string, content []byte) SubtitleInfo {
+	mt.mu.Lock()
+	fileIndex := mt.SelectedFile
+	mt.mu.Unlock()
+	return m.addSubtitle(mt, SubtitleInfo{Name: name, FileIndex: fileIndex, Encoding: encoding, Content: content})
+}
+
+// addSubtitle attaches sub with the next unused index and announces it.
+func (m *TorrentManager) addSubtitle(mt *ManagedTorrent, sub SubtitleInfo) SubtitleInfo {
+	mt.mu.Lock()
+	sub = mt.attachSubtitle(sub)
+	mt.mu.Unlock()
+
+	m.persist(mt)
+	m.events.publish(TorrentEvent{Type: EventSubtitleAdded, TorrentID: mt.ID, Data: sub.Name})
+	return sub
+}
+
+// ShiftSubtitle retimes the subtitle at index and attaches the result as a
+// new subtitle, leaving the original unchanged. See ShiftVTT for how
+// offsetMs and ratio apply.
+func (m *TorrentManager) ShiftSubtitle(id string, index, offsetMs int, ratio float64) (SubtitleInfo, error) {
+	mt, ok := m.GetTorrent(id)
+	if !ok {
+		return SubtitleInfo{}, fmt.Errorf("torrent not found")
+	}
+
+	mt.mu.Lock()
+	var src *SubtitleInfo
+	for i := range mt.Subtitles {
+		if mt.Subtitles[i].Index == index {
+			src = &mt.Subtitles[i]
+			break
+		}
+	}
+	if src == nil {
+		mt.mu.Unlock()
+		return SubtitleInfo{}, fmt.Errorf("subtitle not found")
+	}
+	shifted := SubtitleInfo{FileIndex: src.FileIndex, Encoding: src.Encoding}
+	name, content := src.Name, src.Content
+	mt.mu.Unlock()
+
+	label := fmt.Sprintf("%+dms", offsetMs)
+	if ratio != 1 {
+		label = fmt.Sprintf("%s x%.4g", label, ratio)
+	}
+	shifted.Name = fmt.Sprintf("%s (%s).vtt", stripExt(name), label)
+	shifted.Content = ShiftVTT(content, offsetMs, ratio)
+
+	return m.addSubtitle(mt, shifted), nil
+}
+
+// Subscribe returns a channel of lifecycle events for the torrent and a
+// function that ends the subscription.
+func (m *TorrentManager) Subscribe(id string) (<-chan TorrentEvent, func()) {
+	return m.events.subscribe(id)
+}
+
+// GetSelectedFileReader opens a reader for the torrent's selected file.
+func (m *TorrentManager) GetSelectedFileReader(id string) (torrent.Reader, *torrent.File, error) {
+	mt, ok := m.GetTorrent(id)
+	if !ok {
+		return nil, nil, fmt.Errorf("torrent not found")
+	}
+
+	mt.mu.Lock()
+	selectedIdx := mt.SelectedFile
+	mt.mu.Unlock()
+
+	if selectedIdx < 0 {
+		return nil, nil, fmt.Errorf("no file selected")
+	}
+	return m.GetFileReader(id, selectedIdx)
+}
+
+// RemoveTorrent drops the torrent and its persisted state. With deleteData it
+// also removes the torrent's downloaded pieces from disk.
+func (m *TorrentManager) RemoveTorrent(id string, deleteData bool) error {
 	m.mu.Lock()
 	mt, ok := m.torrents[id]
 	if ok {
-		delete(m.torrents, id)
+		m.detach(mt, false)
 	}
 	m.mu.Unlock()
 
-	if ok {
-		mt.Torrent.Drop()
+	if !ok {
+		return fmt.Errorf("torrent not found")
+	}
+	return m.dropTorrent(mt, deleteData)
+}
+
+// detach stops managing mt and marks it removed, so no stream opens on it
+// afterwards. With idleOnly set a torrent with open streams is kept, and
+// false returned. Callers must hold m.mu.
+func (m *TorrentManager) detach(mt *ManagedTorrent, idleOnly bool) bool {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	if idleOnly && len(mt.streams) > 0 {
+		return false
+	}
+	mt.removed = true
+	delete(m.torrents, mt.ID)
+	return true
+}
+
+// dropTorrent stops a detached torrent and deletes its stored record and,
+// with deleteData, its downloaded data.
+func (m *TorrentManager) dropTorrent(mt *ManagedTorrent, deleteData bool) error {
+	id := mt.ID
+	mt.Torrent.Drop()
+	if err := m.store.Delete(id); err != nil {
+		log.Printf("remove torrent %s from store: %v", id, err)
+	}
+	m.events.publish(TorrentEvent{Type: EventTorrentRemoved, TorrentID: id})
+
+	if deleteData {
+		// A torrent added again since owns the data now
+		if err := m.removeUnmanagedData(id); err != nil && !errors.Is(err, errNotEvictable) {
+			return fmt.Errorf("remove torrent data: %w", err)
+		}
 	}
+	return nil
 }
 
 func (m *TorrentManager) RemoveAll() error {
@@ -256,14 +961,23 @@ func (m *TorrentManager) RemoveAll() error {
 	}
 	for _, id := range ids {
 		if mt, ok := m.torrents[id]; ok {
+			m.detach(mt, false)
 			mt.Torrent.Drop()
-			delete(m.torrents, id)
 		}
 	}
 	m.mu.Unlock()
 
-	// Remove downloaded data on disk
-	entries, err := os.ReadDir(m.dataDir)
+	for _, id := range ids {
+		m.events.publish(TorrentEvent{Type: EventTorrentRemoved, TorrentID: id})
+	}
+
+	if err := m.store.Clear(); err != nil {
+		return fmt.Errorf("clear store: %w", err)
+	}
+
+	// Remove downloaded data on disk, keeping the store itself and the
+	// subtitle cache, which has its own purge
+	entries, err := os.ReadDir(m.cfg.DataDir)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil
@@ -271,21 +985,33 @@ func (m *TorrentManager) RemoveAll() error {
 		return fmt.Errorf("read data dir: %w", err)
 	}
 	for _, e := range entries {
-		os.RemoveAll(filepath.Join(m.dataDir, e.Name()))
+		if e.Name() == storeFileName || e.Name() == subtitleCacheDir {
+			continue
+		}
+		os.RemoveAll(filepath.Join(m.cfg.DataDir, e.Name()))
 	}
 	return nil
 }
 
-func (m *TorrentManager) CleanupLoop(ctx context.Context, maxAge time.Duration) {
-	ticker := time.NewTicker(10 * time.Minute)
+// CleanupLoop removes idle torrents and enforces the disk quota until ctx is
+// cancelled.
+func (m *TorrentManager) CleanupLoop(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(m.cfg.CleanupInterval))
 	defer ticker.Stop()
 
+	// Disk usage can grow quickly while streaming, so check the quota often
+	quotaTicker := time.NewTicker(time.Duration(m.cfg.QuotaInterval))
+	defer quotaTicker.Stop()
+
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			m.cleanup(maxAge)
+			m.cleanup(time.Duration(m.cfg.CleanupMaxAge))
+			m.persistAll()
+		case <-quotaTicker.C:
+			m.enforceDiskQuota()
 		}
 	}
 }
@@ -303,33 +1029,384 @@ func (m *TorrentManager) cleanup(maxAge time.Duration) {
 	m.mu.RUnlock()
 
 	for _, id := range stale {
-		m.RemoveTorrent(id)
+		m.RemoveTorrent(id, false)
+	}
+}
+
+// applyPriorities downloads the selected file and every file with an open
+// reader, and nothing else. Callers must hold mt.mu and the torrent must be
+// ready.
+func (mt *ManagedTorrent) applyPriorities() {
+	for i, f := range mt.Torrent.Files() {
+		_, streaming := mt.streams[i]
+		switch {
+		case i != mt.SelectedFile && !streaming:
+			f.SetPriority(torrent.PiecePriorityNone)
+		case mt.Files[i].IsImage:
+			f.SetPriority(torrent.PiecePriorityNow)
+		default:
+			f.SetPriority(torrent.PiecePriorityNormal)
+		}
+	}
+}
+
+func (mt *ManagedTorrent) releaseStream(fileIndex int, sr *streamReader) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	fs := mt.streams[fileIndex]
+	delete(fs.readers, sr)
+	if len(fs.readers) == 0 {
+		mt.pieces.set(mt.Torrent, fs, nil)
+		delete(mt.streams, fileIndex)
+	}
+	mt.applyPriorities()
+}
+
+// enforceDiskQuota evicts torrent data until usage under the data directory
+// is within MaxDisk. Data left behind by torrents no longer managed goes first, then
+// managed torrents in least recently accessed order. Torrents with open
+// streams are never evicted.
+func (m *TorrentManager) enforceDiskQuota() {
+	maxDisk := int64(m.cfg.MaxDisk)
+	if maxDisk <= 0 {
+		return
+	}
+
+	usage, err := dirUsage(m.cfg.DataDir)
+	if err != nil {
+		log.Printf("disk quota: %v", err)
+		return
+	}
+	if usage <= maxDisk {
+		return
+	}
+
+	type candidate struct {
+		id           string
+		mt           *ManagedTorrent
+		lastAccessed time.Time
+	}
+	var candidates []candidate
+
+	m.mu.RLock()
+	entries, err := os.ReadDir(m.cfg.DataDir)
+	if err != nil {
+		m.mu.RUnlock()
+		log.Printf("disk quota: read data dir: %v", err)
+		return
+	}
+	for _, e := range entries {
+		if !e.IsDir() || !isInfoHash(e.Name()) {
+			continue
+		}
+		if _, managed := m.torrents[e.Name()]; !managed {
+			// Orphaned data sorts before every managed torrent
+			candidates = append(candidates, candidate{id: e.Name()})
+		}
+	}
+	for id, mt := range m.torrents {
+		mt.mu.Lock()
+		if len(mt.streams) == 0 {
+			candidates = append(candidates, candidate{id: id, mt: mt, lastAccessed: mt.LastAccessed})
+		}
+		mt.mu.Unlock()
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].lastAccessed.Before(candidates[j].lastAccessed)
+	})
+
+	for _, c := range candidates {
+		if usage <= maxDisk {
+			return
+		}
+		dir := filepath.Join(m.cfg.DataDir, c.id)
+		size, err := dirUsage(dir)
+		if err != nil {
+			log.Printf("disk quota: %v", err)
+			continue
+		}
+		if c.mt != nil {
+			err = m.evictTorrent(c.mt)
+		} else {
+			err = m.removeUnmanagedData(c.id)
+		}
+		if errors.Is(err, errNotEvictable) {
+			continue
+		}
+		if err != nil {
+			log.Printf("disk quota: evict %s: %v", c.id, err)
+			continue
+		}
+		log.Printf("Disk quota: evicted %s (%d bytes)", c.id, size)
+		usage -= size
+	}
+
+	if usage > maxDisk {
+		log.Printf("disk quota: usage %d bytes still above limit %d with nothing evictable left", usage, maxDisk)
 	}
 }
 
+// errNotEvictable is returned when torrent data picked for deletion has come
+// into use since.
+var errNotEvictable = errors.New("in use")
+
+// evictTorrent removes mt and its data unless it has been removed or started
+// streaming since it was picked. Both are checked under the same locks
+// GetFileReader takes, so no stream opens on data being deleted.
+func (m *TorrentManager) evictTorrent(mt *ManagedTorrent) error {
+	m.mu.Lock()
+	ok := m.torrents[mt.ID] == mt && m.detach(mt, true)
+	m.mu.Unlock()
+	if !ok {
+		return errNotEvictable
+	}
+	return m.dropTorrent(mt, true)
+}
+
+// removeUnmanagedData deletes the data of a torrent that is not managed,
+// returning errNotEvictable if it is. The directory is moved aside under
+// m.mu, which AddTorrentSpec holds while the client opens a torrent's
+// storage, so a torrent added again never has its new data deleted.
+func (m *TorrentManager) removeUnmanagedData(id string) error {
+	// storage.NewFileByInfoHash keeps each torrent under its infohash
+	dir := filepath.Join(m.cfg.DataDir, id)
+	trash := filepath.Join(m.cfg.DataDir, ".removing-"+id)
+
+	m.mu.Lock()
+	if _, managed := m.torrents[id]; managed {
+		m.mu.Unlock()
+		return errNotEvictable
+	}
+	err := os.Rename(dir, trash)
+	m.mu.Unlock()
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(trash)
+}
+
+// sampleRates periodically updates each torrent's transfer rates until the
+// manager is closed.
+func (m *TorrentManager) sampleRates() {
+	ticker := time.NewTicker(rateSampleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.closed:
+			return
+		case now := <-ticker.C:
+			m.mu.RLock()
+			all := make([]*ManagedTorrent, 0, len(m.torrents))
+			for _, mt := range m.torrents {
+				all = append(all, mt)
+			}
+			m.mu.RUnlock()
+
+			for _, mt := range all {
+				mt.sampleRate(now)
+			}
+		}
+	}
+}
+
+func (mt *ManagedTorrent) sampleRate(now time.Time) {
+	stats := mt.Torrent.Stats()
+	read := stats.BytesReadData.Int64()
+	written := stats.BytesWrittenData.Int64()
+
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	r := &mt.rate
+	if !r.sampledAt.IsZero() {
+		if dt := now.Sub(r.sampledAt).Seconds(); dt > 0 {
+			r.Down = float64(read-r.read) / dt
+			r.Up = float64(written-r.written) / dt
+		}
+	}
+	r.sampledAt = now
+	r.read = read
+	r.written = written
+}
+
 func (m *TorrentManager) Close() {
+	close(m.closed)
+	m.persistAll()
 	m.client.Close()
+	m.store.Close()
 }
 
 func classifyFiles(t *torrent.Torrent) []FileInfo {
 	var files []FileInfo
 	for i, f := range t.Files() {
 		ext := strings.ToLower(filepath.Ext(f.DisplayPath()))
-		files = append(files, FileInfo{
+		info := FileInfo{
 			Index:      i,
 			Path:       f.DisplayPath(),
 			Length:     f.Length(),
 			IsVideo:    videoExtensions[ext],
 			IsSubtitle: subtitleExtensions[ext],
 			IsImage:    imageExtensions[ext],
-		})
+		}
+		if info.IsVideo {
+			media := mediaInfoFor(t.Name(), info.Path)
+			info.Media = &media
+		}
+		files = append(files, info)
 	}
 	return files
 }
 
-func readTorrentFile(f *torrent.File) ([]byte, error) {
+// pieceRange is a half-open span [Start, End) of piece indices.
+type pieceRange struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// byteRange is a half-open span [Start, End) of bytes.
+type byteRange struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// FilePieces reports which parts of a file are downloaded.
+type FilePieces struct {
+	Length      int64       `json:"length"`
+	PieceLength int64       `json:"pieceLength"`
+	Ranges      []byteRange `json:"ranges"`
+}
+
+// FilePieces returns the completed byte ranges of a file, so players can
+// show which parts will seek instantly.
+func (m *TorrentManager) FilePieces(id string, fileIndex int) (FilePieces, error) {
+	mt, ok := m.peek(id)
+	if !ok {
+		return FilePieces{}, fmt.Errorf("torrent not found")
+	}
+
+	mt.mu.Lock()
+	ready := mt.State == StateReady
+	mt.mu.Unlock()
+	if !ready {
+		return FilePieces{}, fmt.Errorf("torrent metadata not ready")
+	}
+	files := mt.Torrent.Files()
+	if fileIndex < 0 || fileIndex >= len(files) {
+		return FilePieces{}, fmt.Errorf("file index out of range")
+	}
+
+	f := files[fileIndex]
+	pieceLength := mt.Torrent.Info().PieceLength
+	return FilePieces{
+		Length:      f.Length(),
+		PieceLength: pieceLength,
+		Ranges:      fileByteRanges(completedPieces(mt.Torrent), pieceLength, f.Offset(), f.Length()),
+	}, nil
+}
+
+// fileByteRanges turns the torrent's completed pieces into merged byte ranges
+// of the file at offset off, relative to the file's start.
+func fileByteRanges(done []bool, pieceLength, off, length int64) []byteRange {
+	ranges := []byteRange{}
+	if length <= 0 {
+		return ranges
+	}
+	for i := off / pieceLength; i <= (off+length-1)/pieceLength && i < int64(len(done)); i++ {
+		if !done[i] {
+			continue
+		}
+		start := max(i*pieceLength, off) - off
+		end := min((i+1)*pieceLength, off+length) - off
+		if n := len(ranges); n > 0 && ranges[n-1].End == start {
+			ranges[n-1].End = end
+		} else {
+			ranges = append(ranges, byteRange{Start: start, End: end})
+		}
+	}
+	return ranges
+}
+
+// completedPieces reports which of the torrent's pieces are complete.
+func completedPieces(t *torrent.Torrent) []bool {
+	done := make([]bool, 0, t.NumPieces())
+	for _, run := range t.PieceStateRuns() {
+		for i := 0; i < run.Length; i++ {
+			done = append(done, run.Complete)
+		}
+	}
+	return done
+}
+
+// newPieceRanges returns the contiguous spans of pieces complete in cur but
+// not in prev.
+func newPieceRanges(prev, cur []bool) []pieceRange {
+	var ranges []pieceRange
+	start := -1
+	for i, done := range cur {
+		isNew := done && (i >= len(prev) || !prev[i])
+		switch {
+		case isNew && start < 0:
+			start = i
+		case !isNew && start >= 0:
+			ranges = append(ranges, pieceRange{Start: start, End: i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		ranges = append(ranges, pieceRange{Start: start, End: len(cur)})
+	}
+	return ranges
+}
+
+// dirUsage sums the on-disk size of all files under dir.
+func dirUsage(dir string) (int64, error) {
+	var total int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		total += allocatedSize(info)
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("measure %s: %w", dir, err)
+	}
+	return total, nil
+}
+
+func isInfoHash(name string) bool {
+	if len(name) != 40 {
+		return false
+	}
+	for _, r := range name {
+		if !strings.ContainsRune("0123456789abcdef", r) {
+			return false
+		}
+	}
+	return true
+}
+
+func readTorrentFile(ctx context.Context, f *torrent.File) ([]byte, error) {
 	reader := f.NewReader()
 	defer reader.Close()
+	reader.SetContext(ctx)
 	return io.ReadAll(reader)
 }
 
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// testFile is a file of a torrent built by addTestTorrent. Files with data
+// are written to disk before the torrent is added, so their pieces are
+// complete; the rest have length zero bytes that never arrive.
+type testFile struct {
+	path   string
+	length int64
+	data   []byte
+}
+
+// newTestManager starts a manager with its data under a temporary
+// directory.
+func newTestManager(t *testing.T) *TorrentManager {
+	t.Helper()
+	cfg := DefaultTorrentManagerConfig()
+	cfg.DataDir = t.TempDir()
+	m, err := NewTorrentManager(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(m.Close)
+	return m
+}
+
+// addTestTorrent adds a torrent of files to m and checks the data on disk.
+// There are no peers, so only pieces lying wholly within files with data are
+// ever complete.
+func addTestTorrent(t *testing.T, m *TorrentManager, pieceLength int64, files ...testFile) *ManagedTorrent {
+	t.Helper()
+	info := metainfo.Info{Name: "test", PieceLength: pieceLength}
+	var content []byte
+	for _, f := range files {
+		if f.data != nil {
+			f.length = int64(len(f.data))
+			content = append(content, f.data...)
+		} else {
+			content = append(content, make([]byte, f.length)...)
+		}
+		info.Files = append(info.Files, metainfo.FileInfo{Path: []string{f.path}, Length: f.length})
+	}
+	for off := 0; off < len(content); off += int(pieceLength) {
+		sum := sha1.Sum(content[off:min(off+int(pieceLength), len(content))])
+		info.Pieces = append(info.Pieces, sum[:]...)
+	}
+	infoBytes, err := bencode.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(m.cfg.DataDir, metainfo.HashBytes(infoBytes).HexString(), info.Name)
+	for _, f := range files {
+		if f.data == nil {
+			continue
+		}
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, f.path), f.data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := (&metainfo.MetaInfo{InfoBytes: infoBytes}).Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	mt, err := m.AddTorrentFile(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mt.Torrent.VerifyData(); err != nil {
+		t.Fatal(err)
+	}
+	return mt
+}
+
+func TestFileByteRanges(t *testing.T) {
+	// Pieces of 10 bytes; the file spans bytes 15-54 of the torrent, so it
+	// starts and ends partway through a piece
+	done := []bool{true, true, false, true, true, false, false}
+	tests := []struct {
+		name        string
+		done        []bool
+		off, length int64
+		want        []byteRange
+	}{
+		{"partial pieces at both ends", done, 15, 40, []byteRange{{0, 5}, {15, 35}}},
+		{"whole torrent", done, 0, 70, []byteRange{{0, 20}, {30, 50}}},
+		{"nothing done", make([]bool, 7), 15, 40, []byteRange{}},
+		{"empty file", done, 20, 0, []byteRange{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := fileByteRanges(tt.done, 10, tt.off, tt.length); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("fileByteRanges() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPersistSkipsRemovedTorrent(t *testing.T) {
+	m := newTestManager(t)
+	mt := addTestTorrent(t, m, 1<<16, testFile{path: "movie.mkv", length: 1 << 20})
+	if err := m.RemoveTorrent(mt.ID, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// A select or subtitle load finishing after the removal
+	m.persist(mt)
+
+	recs, err := m.store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := recs[mt.ID]; ok {
+		t.Error("removed torrent was written back to the store")
+	}
+}
+
+func TestEnforceDiskQuota(t *testing.T) {
+	m := newTestManager(t)
+	const size = 1 << 20
+	add := func(name string, accessed time.Duration) *ManagedTorrent {
+		mt := addTestTorrent(t, m, 1<<16, testFile{path: name, data: bytes.Repeat([]byte(name[:1]), size)})
+		mt.mu.Lock()
+		mt.LastAccessed = time.Now().Add(-accessed)
+		mt.mu.Unlock()
+		return mt
+	}
+	streaming := add("b.mkv", 4*time.Hour)
+	oldest := add("a.mkv", 3*time.Hour)
+	older := add("c.mkv", time.Hour)
+	recent := add("d.mkv", 0)
+
+	orphan := filepath.Join(m.cfg.DataDir, "0123456789abcdef0123456789abcdef01234567")
+	if err := os.MkdirAll(orphan, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(orphan, "left.mkv"), make([]byte, size), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, _, err := m.GetFileReader(streaming.ID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	// Three files have to go: the orphan, then the least recently accessed
+	// torrents not streaming
+	usage, err := dirUsage(m.cfg.DataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.cfg.MaxDisk = ByteSize(usage - 5*size/2)
+	m.enforceDiskQuota()
+
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Errorf("orphaned data kept: %v", err)
+	}
+	for _, tt := range []struct {
+		name string
+		mt   *ManagedTorrent
+		kept bool
+	}{
+		{"streaming", streaming, true},
+		{"oldest", oldest, false},
+		{"older", older, false},
+		{"recent", recent, true},
+	} {
+		_, managed := m.peek(tt.mt.ID)
+		_, err := os.Stat(filepath.Join(m.cfg.DataDir, tt.mt.ID))
+		if managed != tt.kept || (err == nil) != tt.kept {
+			t.Errorf("%s torrent: managed %v, data error %v; want kept %v", tt.name, managed, err, tt.kept)
+		}
+	}
+}
+
+func TestSubtitlesKeptPerVideo(t *testing.T) {
+	m := newTestManager(t)
+	mt := addTestTorrent(t, m, 1<<16,
+		testFile{path: "Show.S01E01.mp4", length: 1 << 20},
+		testFile{path: "Show.S01E02.mp4", length: 1 << 20})
+	const vtt = "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nHi\n"
+
+	// Two viewers pick different episodes, each adding a subtitle
+	if _, err := m.SelectFile(mt.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	first := m.AddSubtitle(mt, "first.vtt", "UTF-8", []byte(vtt))
+	if _, err := m.SelectFile(mt.ID, 1); err != nil {
+		t.Fatal(err)
+	}
+	second := m.AddSubtitle(mt, "second.vtt", "UTF-8", []byte(vtt))
+	shifted, err := m.ShiftSubtitle(mt.ID, first.Index, 500, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	names := func(subs []SubtitleInfo) (got []string) {
+		for _, s := range subs {
+			got = append(got, fmt.Sprintf("%d %s", s.Index, s.Name))
+		}
+		return got
+	}
+	if got, want := names(mt.subtitlesFor(0)), []string{"-1 first.vtt", "-3 first (+500ms).vtt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("first episode subtitles = %q, want %q", got, want)
+	}
+	if got, want := names(mt.subtitlesFor(1)), []string{"-2 second.vtt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("second episode subtitles = %q, want %q", got, want)
+	}
+	if second.FileIndex != 1 || shifted.FileIndex != 0 {
+		t.Errorf("file indexes: second %d, shifted %d", second.FileIndex, shifted.FileIndex)
+	}
+}
+
+func TestSidecarSubtitlesLoadInBackground(t *testing.T) {
+	m := newTestManager(t)
+	srt := []byte("1\n00:00:01,000 --> 00:00:02,000\nHello\n")
+	srt = append(srt, bytes.Repeat([]byte("\n"), 1<<14-len(srt))...)
+	// The English subtitle fills a piece on disk; the French one never
+	// arrives
+	mt := addTestTorrent(t, m, 1<<14,
+		testFile{path: "Show.en.srt", data: srt},
+		testFile{path: "Show.mp4", length: 1 << 20},
+		testFile{path: "Show.fr.srt", length: 100})
+	events, unsubscribe := m.Subscribe(mt.ID)
+	defer unsubscribe()
+
+	start := time.Now()
+	if _, err := m.SelectFile(mt.ID, 1); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("select took %v", elapsed)
+	}
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ev := <-events:
+			if ev.Type != EventSubtitleAdded {
+				continue
+			}
+			if ev.Data != "Show.en.srt" {
+				t.Fatalf("added %v", ev.Data)
+			}
+			mt.mu.Lock()
+			subs := mt.subtitlesFor(1)
+			mt.mu.Unlock()
+			if len(subs) != 1 || subs[0].Index != 0 || !bytes.Contains(subs[0].Content, []byte("00:00:01.000 --> 00:00:02.000")) {
+				t.Errorf("subtitles = %+v", subs)
+			}
+			return
+		case <-timeout:
+			t.Fatal("subtitle file not attached")
+		}
+	}
+}
+
+func TestStreamsKeepFilePriority(t *testing.T) {
+	m := newTestManager(t)
+	mt := addTestTorrent(t, m, 1<<16,
+		testFile{path: "Show.S01E01.mp4", length: 1 << 20},
+		testFile{path: "Show.S01E02.mp4", length: 1 << 20},
+		testFile{path: "Show.S01E03.mp4", length: 1 << 20})
+	files := mt.Torrent.Files()
+	priorities := func() []torrent.PiecePriority {
+		var got []torrent.PiecePriority
+		for _, f := range files {
+			got = append(got, f.Priority())
+		}
+		return got
+	}
+	none, normal := torrent.PiecePriorityNone, torrent.PiecePriorityNormal
+
+	first, _, err := m.GetFileReader(mt.ID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _, err := m.GetFileReader(mt.ID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := priorities(), []torrent.PiecePriority{normal, normal, none}; !reflect.DeepEqual(got, want) {
+		t.Errorf("with two streams, priorities = %v, want %v", got, want)
+	}
+
+	first.Close()
+	if got, want := priorities(), []torrent.PiecePriority{none, normal, none}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after closing the first stream, priorities = %v, want %v", got, want)
+	}
+	second.Close()
+	if got, want := priorities(), []torrent.PiecePriority{none, none, none}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after closing both streams, priorities = %v, want %v", got, want)
+	}
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	if len(mt.streams) != 0 {
+		t.Errorf("%d files still streaming", len(mt.streams))
+	}
+}
+
+func TestPersistRestoresTorrents(t *testing.T) {
+	cfg := DefaultTorrentManagerConfig()
+	cfg.DataDir = t.TempDir()
+	m, err := NewTorrentManager(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mt := addTestTorrent(t, m, 1<<16,
+		testFile{path: "Show.S01E01.mp4", length: 1 << 20},
+		testFile{path: "Show.S01E02.mp4", length: 1 << 20})
+	if _, err := m.SelectFile(mt.ID, 1); err != nil {
+		t.Fatal(err)
+	}
+	const vtt = "WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nHi\n"
+	sub := m.AddSubtitle(mt, "uploaded.vtt", "Windows-1252", []byte(vtt))
+	m.Close()
+
+	restored, err := NewTorrentManager(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+
+	got, ok := restored.peek(mt.ID)
+	if !ok {
+		t.Fatal("torrent not restored")
+	}
+	got.mu.Lock()
+	defer got.mu.Unlock()
+	if got.State != StateReady || len(got.Files) != 2 || got.SelectedFile != 1 {
+		t.Errorf("restored state %s, %d files, selected %d", got.State, len(got.Files), got.SelectedFile)
+	}
+	want := []SubtitleInfo{{Name: "uploaded.vtt", Index: sub.Index, FileIndex: 1, Encoding: "Windows-1252", Content: []byte(vtt)}}
+	if !reflect.DeepEqual(got.Subtitles, want) {
+		t.Errorf("restored subtitles = %+v, want %+v", got.Subtitles, want)
+	}
+
+	// New subtitles don't take the restored one's index
+	if next := got.attachSubtitle(SubtitleInfo{Name: "next.vtt"}); next.Index == sub.Index {
+		t.Errorf("index %d reused", next.Index)
+	}
+}
+
+func TestMetadataTimeoutFails(t *testing.T) {
+	m := newTestManager(t)
+	m.cfg.MetadataTimeout = Duration(50 * time.Millisecond)
+
+	const id = "0123456789abcdef0123456789abcdef01234567"
+	const magnet = "magnet:?xt=urn:btih:" + id
+	events, unsubscribe := m.Subscribe(id)
+	defer unsubscribe()
+	mt, err := m.AddMagnet(magnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case ev := <-events:
+		if ev.Type != EventMetadataFailed {
+			t.Fatalf("event %s, want %s", ev.Type, EventMetadataFailed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("metadata never timed out")
+	}
+	mt.mu.Lock()
+	state, reason := mt.State, mt.Error
+	mt.mu.Unlock()
+	if state != StateFailed || reason == "" {
+		t.Errorf("state %s with reason %q, want %s with a reason", state, reason, StateFailed)
+	}
+
+	// Adding it again starts a fresh attempt
+	m.cfg.MetadataTimeout = Duration(time.Hour)
+	retry, err := m.AddMagnet(magnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retry == mt {
+		t.Fatal("re-add returned the failed attempt")
+	}
+	retry.mu.Lock()
+	defer retry.mu.Unlock()
+	if retry.State != StateFetchingMetadata || retry.Error != "" {
+		t.Errorf("retry state %s with reason %q, want %s", retry.State, retry.Error, StateFetchingMetadata)
+	}
+	if got, _ := m.peek(mt.ID); got != retry {
+		t.Error("retry isn't the managed torrent")
+	}
+}
+
+func TestNewPieceRanges(t *testing.T) {
+	tests := []struct {
+		name      string
+		prev, cur []bool
+		want      []pieceRange
+	}{
+		{"no change", []bool{true, false, true}, []bool{true, false, true}, nil},
+		{"first snapshot", nil, []bool{true, true, false, true}, []pieceRange{{0, 2}, {3, 4}}},
+		{"single new piece", []bool{true, false, false}, []bool{true, true, false}, []pieceRange{{1, 2}}},
+		{"merged run", []bool{false, true, false, false}, []bool{true, true, true, true}, []pieceRange{{0, 1}, {2, 4}}},
+		{"run to end", []bool{true, false, false}, []bool{true, true, true}, []pieceRange{{1, 3}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := newPieceRanges(tt.prev, tt.cur); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("newPieceRanges(%v, %v) = %v, want %v", tt.prev, tt.cur, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemoveTorrentDeletesData(t *testing.T) {
+	m := newTestManager(t)
+	data := bytes.Repeat([]byte{1}, 1<<16)
+	gone := addTestTorrent(t, m, 1<<16, testFile{path: "gone.mkv", length: 1 << 16, data: data})
+	kept := addTestTorrent(t, m, 1<<16, testFile{path: "kept.mkv", length: 1 << 16, data: data})
+
+	if err := m.RemoveTorrent(gone.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(m.cfg.DataDir, gone.ID)); !os.IsNotExist(err) {
+		t.Errorf("removed torrent's data: stat err = %v, want not exist", err)
+	}
+	if _, err := os.Stat(filepath.Join(m.cfg.DataDir, kept.ID, "test", "kept.mkv")); err != nil {
+		t.Errorf("other torrent's data: %v", err)
+	}
+
+	stored, err := m.store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := stored[gone.ID]; ok {
+		t.Error("removed torrent still in store")
+	}
+	if _, ok := stored[kept.ID]; !ok {
+		t.Error("other torrent missing from store")
+	}
+	if _, ok := m.peek(gone.ID); ok {
+		t.Error("removed torrent still managed")
+	}
+	if err := m.RemoveTorrent(gone.ID, true); err == nil {
+		t.Error("removing twice succeeded")
+	}
+}